@@ -1,39 +1,180 @@
 package network
 
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DumbNetwork is an in-process hub. Each node gets a DumbNetworkEndpoint
+//   that implements Network[T], and a Send is pushed straight into the
+//   receiver's inbox, so several protocol nodes can run in one process
+//   without opening any ports. Every message is copied through gob on
+//   the way, so like over TCP the receiver never shares slices or maps
+//   with the sender.
 type DumbNetwork[T any] struct {
-	numNodes      int
-	internalQueue [][]T
+	lock      sync.Mutex
+	endpoints map[int]*DumbNetworkEndpoint[T]
+}
+
+type DumbNetworkEndpoint[T any] struct {
+	hub       *DumbNetwork[T]
+	nodeId    int
+	inbox     *Inbox[T]
+	listening bool
 }
 
+var _ Network[int] = &DumbNetworkEndpoint[int]{}
+
 func (net *DumbNetwork[T]) Initialize(numNodes int) {
-	net.numNodes = numNodes
-	net.internalQueue = make([][]T, numNodes)
+	net.endpoints = make(map[int]*DumbNetworkEndpoint[T])
 	for i := 0; i < numNodes; i++ {
-		net.internalQueue[i] = make([]T, 0)
+		net.Endpoint(i)
 	}
 }
 
-func (net *DumbNetwork[T]) Send(recNodeId int, msg T) {
-	net.internalQueue[recNodeId] = append(net.internalQueue[recNodeId], msg)
+// Endpoint returns the endpoint for nodeId, creating it if needed. It
+//   only receives messages once Listen has been called on it.
+func (net *DumbNetwork[T]) Endpoint(nodeId int) *DumbNetworkEndpoint[T] {
+	net.lock.Lock()
+	defer net.lock.Unlock()
+
+	if net.endpoints == nil {
+		net.endpoints = make(map[int]*DumbNetworkEndpoint[T])
+	}
+	endpoint, ok := net.endpoints[nodeId]
+	if !ok {
+		endpoint = &DumbNetworkEndpoint[T]{
+			hub:    net,
+			nodeId: nodeId,
+			inbox:  MakeInbox(make([]T, 0)),
+		}
+		net.endpoints[nodeId] = endpoint
+	}
+	return endpoint
 }
 
-func (net *DumbNetwork[T]) Broadcast(msg T) {
-	for i := 0; i < net.numNodes; i++ {
-		net.internalQueue[i] = append(net.internalQueue[i], msg)
+// nodeIds is sorted so broadcasts are delivered in a fixed order
+func (net *DumbNetwork[T]) nodeIds() []int {
+	net.lock.Lock()
+	defer net.lock.Unlock()
+
+	ids := make([]int, 0, len(net.endpoints))
+	for nodeId := range net.endpoints {
+		ids = append(ids, nodeId)
 	}
+	sort.Ints(ids)
+	return ids
 }
 
-func (net *DumbNetwork[T]) BroadcastToRest(msg T) {
-	for i := 0; i < net.numNodes; i++ {
-		net.internalQueue[i] = append(net.internalQueue[i], msg)
+func (net *DumbNetwork[T]) deliver(from int, to int, msg T) error {
+	net.lock.Lock()
+	endpoint, ok := net.endpoints[to]
+	listening := ok && endpoint.listening
+	net.lock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("node %d error: nodeId %d does not exist in network id table.", from, to)
+	}
+	if !listening {
+		return fmt.Errorf("node %d error: node %d is not listening", from, to)
+	}
+	msg, err := copyMessage(msg)
+	if err != nil {
+		return fmt.Errorf("node %d error: could not encode message for node %d: %v", from, to, err)
 	}
+	endpoint.inbox.Push(msg)
+	return nil
 }
 
-func (net *DumbNetwork[T]) Receive(nodeId int) (valid bool, msg T) {
-	if len(net.internalQueue[nodeId]) == 0 {
-		var t T
-		return false, t
+func copyMessage[T any](msg T) (T, error) {
+	var buffer bytes.Buffer
+	var copied T
+	if err := gob.NewEncoder(&buffer).Encode(msg); err != nil {
+		return copied, err
 	}
-	msg, net.internalQueue[nodeId] = net.internalQueue[nodeId][0], net.internalQueue[nodeId][1:]
-	return true, msg
+	err := gob.NewDecoder(&buffer).Decode(&copied)
+	return copied, err
+}
+
+// Only the initial queue is used, the endpoint's id and peers come from
+//   the hub
+func (endpoint *DumbNetworkEndpoint[T]) Initialize(nodeId int, port string,
+	queue []T, nodeIdTable map[int]string, protocol string) {
+
+	for _, msg := range queue {
+		endpoint.inbox.Push(msg)
+	}
+}
+
+func (endpoint *DumbNetworkEndpoint[T]) Listen() error {
+	endpoint.hub.lock.Lock()
+	defer endpoint.hub.lock.Unlock()
+
+	endpoint.listening = true
+	return nil
+}
+
+func (endpoint *DumbNetworkEndpoint[T]) ListenOnPort(port string) error {
+	return endpoint.Listen()
+}
+
+func (endpoint *DumbNetworkEndpoint[T]) Send(nodeId int, msg T) error {
+	return endpoint.hub.deliver(endpoint.nodeId, nodeId, msg)
+}
+
+func (endpoint *DumbNetworkEndpoint[T]) Broadcast(msg T) error {
+	var err error
+	for _, nodeId := range endpoint.hub.nodeIds() {
+		if sendErr := endpoint.Send(nodeId, msg); sendErr != nil {
+			err = sendErr
+		}
+	}
+	return err
+}
+
+func (endpoint *DumbNetworkEndpoint[T]) BroadcastToRest(msg T) error {
+	var err error
+	for _, nodeId := range endpoint.hub.nodeIds() {
+		if nodeId != endpoint.nodeId {
+			if sendErr := endpoint.Send(nodeId, msg); sendErr != nil {
+				err = sendErr
+			}
+		}
+	}
+	return err
+}
+
+func (endpoint *DumbNetworkEndpoint[T]) Multicast(nodeIds []int, msg T) error {
+	for _, nodeId := range nodeIds {
+		if err := endpoint.Send(nodeId, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The hub routes by id, so there are no addresses to change
+func (endpoint *DumbNetworkEndpoint[T]) SetNodeAddress(nodeId int, address string) {}
+
+func (endpoint *DumbNetworkEndpoint[T]) RemoveNode(nodeId int) {}
+
+func (endpoint *DumbNetworkEndpoint[T]) Receive() (msg T, ok bool) {
+	return endpoint.inbox.Receive()
+}
+
+func (endpoint *DumbNetworkEndpoint[T]) ReceiveTimeout(d time.Duration) (msg T, ok bool) {
+	return endpoint.inbox.ReceiveTimeout(d)
+}
+
+func (endpoint *DumbNetworkEndpoint[T]) ReceiveContext(ctx context.Context) (T, error) {
+	return endpoint.inbox.ReceiveContext(ctx)
+}
+
+func (endpoint *DumbNetworkEndpoint[T]) Messages() <-chan T {
+	return endpoint.inbox.Messages()
 }
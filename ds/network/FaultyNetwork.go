@@ -0,0 +1,386 @@
+package network
+
+import (
+	"context"
+	"flads/util"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LatencyDistribution draws the delay for one delivery
+type LatencyDistribution func(rng *rand.Rand) time.Duration
+
+func ConstantLatency(d time.Duration) LatencyDistribution {
+	return func(rng *rand.Rand) time.Duration {
+		return d
+	}
+}
+
+func UniformLatency(min time.Duration, max time.Duration) LatencyDistribution {
+	return func(rng *rand.Rand) time.Duration {
+		if max <= min {
+			return min
+		}
+		return min + time.Duration(rng.Int63n(int64(max-min)))
+	}
+}
+
+func ExponentialLatency(min time.Duration, mean time.Duration) LatencyDistribution {
+	return func(rng *rand.Rand) time.Duration {
+		return min + time.Duration(rng.ExpFloat64()*float64(mean))
+	}
+}
+
+// LinkFaults describes what happens to messages sent over one directed
+//   link. The zero value is a perfect link.
+type LinkFaults struct {
+	DropRate      float64
+	DuplicateRate float64
+
+	// A reordered message is held back and delivered after the next
+	//   message on the same link (or after ReorderHold, whichever is first)
+	ReorderRate float64
+	ReorderHold time.Duration
+
+	Latency LatencyDistribution
+}
+
+// FaultInjector holds the fault configuration for a whole cluster. One
+//   injector can be shared by every FaultyNetwork in a process (including
+//   the heartbeat networks), and can be changed while the nodes run. All
+//   randomness comes from a single seeded source, and delays are timed
+//   with its clock.
+type FaultInjector struct {
+	lock       sync.Mutex
+	rng        *rand.Rand
+	clock      util.Clock
+	defaults   LinkFaults
+	links      map[[2]int]LinkFaults
+	partitions map[string][][]int
+}
+
+func MakeFaultInjector(seed int64) *FaultInjector {
+	injector := FaultInjector{
+		rng:        rand.New(rand.NewSource(seed)),
+		clock:      util.SystemClock,
+		links:      make(map[[2]int]LinkFaults),
+		partitions: make(map[string][][]int),
+	}
+	return &injector
+}
+
+func (injector *FaultInjector) SetClock(clock util.Clock) {
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+
+	injector.clock = clock
+}
+
+func (injector *FaultInjector) getClock() util.Clock {
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+
+	return injector.clock
+}
+
+// SetDefaultFaults applies to every link without its own configuration
+func (injector *FaultInjector) SetDefaultFaults(faults LinkFaults) {
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+
+	injector.defaults = faults
+}
+
+func (injector *FaultInjector) SetLinkFaults(from int, to int, faults LinkFaults) {
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+
+	injector.links[[2]int{from, to}] = faults
+}
+
+func (injector *FaultInjector) ClearLinkFaults(from int, to int) {
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+
+	delete(injector.links, [2]int{from, to})
+}
+
+// Partition splits the listed nodes into groups that cannot talk to each
+//   other until Heal(name) is called. Nodes not listed are unaffected.
+func (injector *FaultInjector) Partition(name string, groups ...[]int) {
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+
+	injector.partitions[name] = groups
+}
+
+func (injector *FaultInjector) Heal(name string) {
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+
+	delete(injector.partitions, name)
+}
+
+func (injector *FaultInjector) HealAll() {
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+
+	injector.partitions = make(map[string][][]int)
+}
+
+func (injector *FaultInjector) partitioned(from int, to int) bool {
+	for _, groups := range injector.partitions {
+		fromGroup, toGroup := -1, -1
+		for i, group := range groups {
+			for _, nodeId := range group {
+				if nodeId == from {
+					fromGroup = i
+				}
+				if nodeId == to {
+					toGroup = i
+				}
+			}
+		}
+		if fromGroup != -1 && toGroup != -1 && fromGroup != toGroup {
+			return true
+		}
+	}
+	return false
+}
+
+// plan decides the fate of one message on from -> to. It returns one
+//   delay per copy to deliver (none if the message is lost), and whether
+//   the message should be held back for reordering.
+func (injector *FaultInjector) plan(from int, to int) (delays []time.Duration, reorder bool, hold time.Duration) {
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+
+	if injector.partitioned(from, to) {
+		return nil, false, 0
+	}
+
+	faults, ok := injector.links[[2]int{from, to}]
+	if !ok {
+		faults = injector.defaults
+	}
+
+	if injector.rng.Float64() < faults.DropRate {
+		return nil, false, 0
+	}
+
+	copies := 1
+	if injector.rng.Float64() < faults.DuplicateRate {
+		copies = 2
+	}
+	for i := 0; i < copies; i++ {
+		var delay time.Duration
+		if faults.Latency != nil {
+			delay = faults.Latency(injector.rng)
+		}
+		delays = append(delays, delay)
+	}
+
+	reorder = injector.rng.Float64() < faults.ReorderRate
+	hold = faults.ReorderHold
+	if hold <= 0 {
+		hold = 100 * time.Millisecond
+	}
+	return delays, reorder, hold
+}
+
+// FaultyNetwork wraps any Network[T] and runs every outgoing message
+//   through a FaultInjector. Receiving is passed straight through.
+type FaultyNetwork[T any] struct {
+	inner       Network[T]
+	nodeId      int
+	nodeIdTable map[int]string
+	injector    *FaultInjector
+
+	lock sync.Mutex
+	held map[int][]*heldMessage[T]
+}
+
+type heldMessage[T any] struct {
+	msg      T
+	released bool
+}
+
+var _ Network[int] = &FaultyNetwork[int]{}
+
+func MakeFaultyNetwork[T any](inner Network[T], nodeId int, nodeIdTable map[int]string, injector *FaultInjector) *FaultyNetwork[T] {
+	net := FaultyNetwork[T]{
+		inner:       inner,
+		nodeId:      nodeId,
+		nodeIdTable: nodeIdTable,
+		injector:    injector,
+		held:        make(map[int][]*heldMessage[T]),
+	}
+	return &net
+}
+
+func (net *FaultyNetwork[T]) Initialize(nodeId int, port string,
+	queue []T, nodeIdTable map[int]string, protocol string) {
+
+	net.nodeId = nodeId
+	net.nodeIdTable = nodeIdTable
+	net.inner.Initialize(nodeId, port, queue, nodeIdTable, protocol)
+}
+
+func (net *FaultyNetwork[T]) Listen() error {
+	return net.inner.Listen()
+}
+
+func (net *FaultyNetwork[T]) ListenOnPort(port string) error {
+	return net.inner.ListenOnPort(port)
+}
+
+// Send only returns an error if an undelayed delivery fails; lost and
+//   delayed messages look like successful sends, as they would on a real
+//   network
+func (net *FaultyNetwork[T]) Send(nodeId int, msg T) error {
+	delays, reorder, hold := net.injector.plan(net.nodeId, nodeId)
+	if len(delays) == 0 {
+		return nil
+	}
+
+	if reorder {
+		net.holdBack(nodeId, msg, hold)
+		return nil
+	}
+
+	var err error
+	for _, delay := range delays {
+		if sendErr := net.deliver(nodeId, msg, delay); sendErr != nil {
+			err = sendErr
+		}
+	}
+	net.releaseHeld(nodeId)
+	return err
+}
+
+func (net *FaultyNetwork[T]) deliver(nodeId int, msg T, delay time.Duration) error {
+	if delay <= 0 {
+		return net.inner.Send(nodeId, msg)
+	}
+	net.injector.getClock().AfterFunc(delay, func() {
+		net.inner.Send(nodeId, msg)
+	})
+	return nil
+}
+
+func (net *FaultyNetwork[T]) holdBack(nodeId int, msg T, hold time.Duration) {
+	held := &heldMessage[T]{msg: msg}
+
+	net.lock.Lock()
+	net.held[nodeId] = append(net.held[nodeId], held)
+	net.lock.Unlock()
+
+	net.injector.getClock().AfterFunc(hold, func() {
+		net.lock.Lock()
+		release := !held.released
+		held.released = true
+		net.lock.Unlock()
+
+		if release {
+			net.inner.Send(nodeId, msg)
+		}
+	})
+}
+
+func (net *FaultyNetwork[T]) releaseHeld(nodeId int) {
+	net.lock.Lock()
+	held := net.held[nodeId]
+	delete(net.held, nodeId)
+	toSend := make([]T, 0, len(held))
+	for _, h := range held {
+		if !h.released {
+			h.released = true
+			toSend = append(toSend, h.msg)
+		}
+	}
+	net.lock.Unlock()
+
+	for _, msg := range toSend {
+		net.inner.Send(nodeId, msg)
+	}
+}
+
+func (net *FaultyNetwork[T]) nodeIds() []int {
+	net.lock.Lock()
+	defer net.lock.Unlock()
+
+	ids := make([]int, 0, len(net.nodeIdTable))
+	for nodeId := range net.nodeIdTable {
+		ids = append(ids, nodeId)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// The table may be shared with other networks, so it is copied first
+func (net *FaultyNetwork[T]) SetNodeAddress(nodeId int, address string) {
+	net.lock.Lock()
+	net.nodeIdTable = copyTable(net.nodeIdTable)
+	net.nodeIdTable[nodeId] = address
+	net.lock.Unlock()
+
+	net.inner.SetNodeAddress(nodeId, address)
+}
+
+func (net *FaultyNetwork[T]) RemoveNode(nodeId int) {
+	net.lock.Lock()
+	net.nodeIdTable = copyTable(net.nodeIdTable)
+	delete(net.nodeIdTable, nodeId)
+	net.lock.Unlock()
+
+	net.inner.RemoveNode(nodeId)
+}
+
+func (net *FaultyNetwork[T]) Broadcast(msg T) error {
+	var err error
+	for _, nodeId := range net.nodeIds() {
+		if sendErr := net.Send(nodeId, msg); sendErr != nil {
+			err = sendErr
+		}
+	}
+	return err
+}
+
+func (net *FaultyNetwork[T]) BroadcastToRest(msg T) error {
+	var err error
+	for _, nodeId := range net.nodeIds() {
+		if nodeId != net.nodeId {
+			if sendErr := net.Send(nodeId, msg); sendErr != nil {
+				err = sendErr
+			}
+		}
+	}
+	return err
+}
+
+func (net *FaultyNetwork[T]) Multicast(nodeIds []int, msg T) error {
+	for _, nodeId := range nodeIds {
+		if err := net.Send(nodeId, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (net *FaultyNetwork[T]) Receive() (msg T, ok bool) {
+	return net.inner.Receive()
+}
+
+func (net *FaultyNetwork[T]) ReceiveTimeout(d time.Duration) (msg T, ok bool) {
+	return net.inner.ReceiveTimeout(d)
+}
+
+func (net *FaultyNetwork[T]) ReceiveContext(ctx context.Context) (T, error) {
+	return net.inner.ReceiveContext(ctx)
+}
+
+func (net *FaultyNetwork[T]) Messages() <-chan T {
+	return net.inner.Messages()
+}
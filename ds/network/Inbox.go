@@ -0,0 +1,115 @@
+package network
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Inbox is an unbounded, thread-safe FIFO of received messages. Listener
+//   goroutines Push into it and the protocol loop takes messages out
+//   either by polling (Receive), by blocking (ReceiveTimeout,
+//   ReceiveContext) or through a channel (Messages).
+type Inbox[T any] struct {
+	lock  sync.Mutex
+	queue []T
+
+	// closed and replaced on every Push to wake up blocked receivers
+	arrived chan struct{}
+
+	messages     chan T
+	messagesOnce sync.Once
+}
+
+func MakeInbox[T any](queue []T) *Inbox[T] {
+	inbox := Inbox[T]{
+		queue:   append(make([]T, 0, len(queue)), queue...),
+		arrived: make(chan struct{}),
+	}
+	return &inbox
+}
+
+func (inbox *Inbox[T]) Push(msg T) {
+	inbox.lock.Lock()
+	defer inbox.lock.Unlock()
+
+	inbox.queue = append(inbox.queue, msg)
+	close(inbox.arrived)
+	inbox.arrived = make(chan struct{})
+}
+
+func (inbox *Inbox[T]) Len() int {
+	inbox.lock.Lock()
+	defer inbox.lock.Unlock()
+
+	return len(inbox.queue)
+}
+
+// Receive returns immediately, with ok == false if the inbox is empty
+func (inbox *Inbox[T]) Receive() (msg T, ok bool) {
+	msg, ok, _ = inbox.tryReceive()
+	return msg, ok
+}
+
+// ReceiveTimeout waits up to d for a message to arrive
+func (inbox *Inbox[T]) ReceiveTimeout(d time.Duration) (msg T, ok bool) {
+	if d <= 0 {
+		return inbox.Receive()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	msg, err := inbox.ReceiveContext(ctx)
+	return msg, err == nil
+}
+
+// ReceiveContext waits for a message until ctx is done, in which case
+//   ctx.Err() is returned
+func (inbox *Inbox[T]) ReceiveContext(ctx context.Context) (T, error) {
+	for {
+		msg, ok, arrived := inbox.tryReceive()
+		if ok {
+			return msg, nil
+		}
+
+		select {
+		case <-arrived:
+		case <-ctx.Done():
+			var t T
+			return t, ctx.Err()
+		}
+	}
+}
+
+// Messages returns a channel that every subsequent message is delivered
+//   on. Once it has been called the channel owns the inbox, so the
+//   Receive* methods should no longer be used on it.
+func (inbox *Inbox[T]) Messages() <-chan T {
+	inbox.messagesOnce.Do(func() {
+		inbox.messages = make(chan T)
+		go func() {
+			for {
+				msg, _ := inbox.ReceiveContext(context.Background())
+				inbox.messages <- msg
+			}
+		}()
+	})
+	return inbox.messages
+}
+
+func (inbox *Inbox[T]) tryReceive() (msg T, ok bool, arrived chan struct{}) {
+	inbox.lock.Lock()
+	defer inbox.lock.Unlock()
+
+	if len(inbox.queue) == 0 {
+		var t T
+		return t, false, inbox.arrived
+	}
+
+	msg = inbox.queue[0]
+	var t T
+	inbox.queue[0] = t
+	inbox.queue = inbox.queue[1:]
+	return msg, true, nil
+}
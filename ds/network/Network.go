@@ -11,20 +11,60 @@ package network
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"flads/util"
 	"fmt"
+	"io"
 	"net"
+	"sync"
+	"time"
+)
+
+const (
+	minReconnectBackoff = 50 * time.Millisecond
+	maxReconnectBackoff = 5 * time.Second
 )
 
 // Network Type
 type NetworkClass[T any] struct {
 	nodeId int
 	port   string
-	queue  []T
+	inbox  *Inbox[T]
 
 	nodeIdTable map[int]string
+	tableLock   sync.Mutex
 	protocol    string
+
+	peers     map[int]*peerConn
+	peersLock sync.Mutex
+	clock     util.Clock
+}
+
+// peerConn is a long-lived outgoing stream to a single peer. The gob
+//   encoder is kept for the lifetime of the connection so type info is
+//   only sent once per stream.
+type peerConn struct {
+	lock    sync.Mutex
+	conn    net.Conn
+	writer  *countingWriter
+	encoder *gob.Encoder
+
+	// reconnect backoff
+	backoff   time.Duration
+	nextDial  time.Time
+	lastError error
+}
+
+type countingWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.count += n
+	return n, err
 }
 
 func (network *NetworkClass[T]) Initialize(nodeId int, port string,
@@ -32,9 +72,15 @@ func (network *NetworkClass[T]) Initialize(nodeId int, port string,
 
 	network.nodeId = nodeId
 	network.port = port
-	network.queue = queue
+	network.inbox = MakeInbox(queue)
 	network.nodeIdTable = nodeIdTable
 	network.protocol = protocol
+	network.peers = make(map[int]*peerConn)
+	network.clock = util.SystemClock
+}
+
+func (network *NetworkClass[T]) SetClock(clock util.Clock) {
+	network.clock = clock
 }
 
 // Create node and listen on port
@@ -83,32 +129,187 @@ func (network *NetworkClass[T]) listenForever(listener net.Listener) {
 	}
 }
 
-// Creates connection to the address mapped to, encodes the
-//   message, then closes the connection
+// Encodes the message over the long-lived connection to nodeId,
+//   dialing it first if needed. A connection that fails mid-write is
+//   dropped and redialed once; a peer that cannot be dialed is not
+//   retried until its backoff has expired.
 func (network *NetworkClass[T]) Send(nodeId int, msg T) error {
 
 	// Get address of target node
-	address, ok := network.nodeIdTable[nodeId]
+	address, ok := network.address(nodeId)
 	if !ok {
 		return fmt.Errorf("node %d error: nodeId %d does not exist in network id table.",
 			network.nodeId, nodeId)
 	}
 
-	// Initialize connection with target
-	conn, err := net.Dial(network.protocol, address)
+	if network.protocol == "udp" {
+		return network.sendDatagram(address, msg)
+	}
+
+	peer := network.getPeer(nodeId)
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+
+	hadConn := peer.conn != nil
+	err := network.encodeToPeer(peer, address, msg)
+	if err != nil && hadConn {
+		// The old stream may have been closed by the peer (e.g. it
+		//   restarted), so try once more on a fresh connection
+		err = network.encodeToPeer(peer, address, msg)
+	}
+
+	return err
+}
+
+func (network *NetworkClass[T]) address(nodeId int) (string, bool) {
+	network.tableLock.Lock()
+	defer network.tableLock.Unlock()
+
+	address, ok := network.nodeIdTable[nodeId]
+	return address, ok
+}
+
+func (network *NetworkClass[T]) nodeIds() []int {
+	network.tableLock.Lock()
+	defer network.tableLock.Unlock()
+
+	ids := make([]int, 0, len(network.nodeIdTable))
+	for nodeId := range network.nodeIdTable {
+		ids = append(ids, nodeId)
+	}
+	return ids
+}
+
+// The table is copied before it changes, since the one passed to
+//   Initialize may be shared with other networks
+func (network *NetworkClass[T]) SetNodeAddress(nodeId int, address string) {
+	network.tableLock.Lock()
+	old, ok := network.nodeIdTable[nodeId]
+	if ok && old == address {
+		network.tableLock.Unlock()
+		return
+	}
+	network.nodeIdTable = copyTable(network.nodeIdTable)
+	network.nodeIdTable[nodeId] = address
+	network.tableLock.Unlock()
+
+	if ok {
+		network.dropPeer(nodeId)
+	}
+}
+
+func (network *NetworkClass[T]) RemoveNode(nodeId int) {
+	network.tableLock.Lock()
+	network.nodeIdTable = copyTable(network.nodeIdTable)
+	delete(network.nodeIdTable, nodeId)
+	network.tableLock.Unlock()
+
+	network.dropPeer(nodeId)
+}
+
+func copyTable(table map[int]string) map[int]string {
+	copied := make(map[int]string, len(table))
+	for nodeId, address := range table {
+		copied[nodeId] = address
+	}
+	return copied
+}
+
+// dropPeer closes our connection to nodeId, the next Send dials its
+//   current address
+func (network *NetworkClass[T]) dropPeer(nodeId int) {
+	network.peersLock.Lock()
+	peer, ok := network.peers[nodeId]
+	delete(network.peers, nodeId)
+	network.peersLock.Unlock()
+
+	if ok {
+		peer.lock.Lock()
+		peer.close()
+		peer.lock.Unlock()
+	}
+}
+
+func (network *NetworkClass[T]) getPeer(nodeId int) *peerConn {
+	network.peersLock.Lock()
+	defer network.peersLock.Unlock()
+
+	peer, ok := network.peers[nodeId]
+	if !ok {
+		peer = &peerConn{backoff: minReconnectBackoff}
+		network.peers[nodeId] = peer
+	}
+	return peer
+}
+
+// encodeToPeer must be called with peer.lock held
+func (network *NetworkClass[T]) encodeToPeer(peer *peerConn, address string, msg T) error {
+	if peer.conn == nil {
+		if err := peer.dial(address, network.clock); err != nil {
+			return err
+		}
+	}
+
+	before := peer.writer.count
+	err := peer.encoder.Encode(msg)
+	if err != nil {
+		util.Logger.Println("Error writing to", address, "closing connection:", err)
+		peer.close()
+		return err
+	}
+
+	util.PlotLogger.Printf("Bytes: %d\n", peer.writer.count-before)
+	return nil
+}
+
+func (peer *peerConn) dial(address string, clock util.Clock) error {
+	if clock.Now().Before(peer.nextDial) {
+		return fmt.Errorf("waiting to reconnect to %s: %v", address, peer.lastError)
+	}
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		peer.lastError = err
+		peer.nextDial = clock.Now().Add(peer.backoff)
+		peer.backoff *= 2
+		if peer.backoff > maxReconnectBackoff {
+			peer.backoff = maxReconnectBackoff
+		}
+		return err
+	}
+
+	peer.conn = conn
+	peer.writer = &countingWriter{w: conn}
+	peer.encoder = gob.NewEncoder(peer.writer)
+	peer.backoff = minReconnectBackoff
+	peer.lastError = nil
+	return nil
+}
+
+func (peer *peerConn) close() {
+	if peer.conn != nil {
+		peer.conn.Close()
+	}
+	peer.conn = nil
+	peer.writer = nil
+	peer.encoder = nil
+}
+
+// Datagrams are independent of each other, so every message gets its
+//   own encoder (and therefore its own type info)
+func (network *NetworkClass[T]) sendDatagram(address string, msg T) error {
+	conn, err := net.Dial("udp", address)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 
-	// Encode the message over the connection
 	encoder := gob.NewEncoder(conn)
-	err = encoder.Encode(msg) // Might want encoder.Encode(msg)
-	if network.protocol == "udp" && err != nil {
+	err = encoder.Encode(msg)
+	if err != nil {
 		fmt.Println("sent to", address)
 	}
 
-	// util.Logger.Println("In Send(), sent msg", msg)
 	network.logBytesSent(msg)
 
 	return err
@@ -131,7 +332,7 @@ func (network *NetworkClass[T]) logBytesSent(msg T) {
 func (network *NetworkClass[T]) Broadcast(msg T) error {
 
 	var err error
-	for nodeId, _ := range network.nodeIdTable {
+	for _, nodeId := range network.nodeIds() {
 		// if nodeId != network.nodeId {
 		err = network.Send(nodeId, msg)
 		if err != nil {
@@ -146,7 +347,7 @@ func (network *NetworkClass[T]) Broadcast(msg T) error {
 func (network *NetworkClass[T]) BroadcastToRest(msg T) error {
 
 	var err error
-	for nodeId, _ := range network.nodeIdTable {
+	for _, nodeId := range network.nodeIds() {
 		if nodeId != network.nodeId {
 			err = network.Send(nodeId, msg)
 			if err != nil {
@@ -172,42 +373,43 @@ func (network *NetworkClass[T]) Multicast(nodeIds []int, msg T) error {
 }
 
 func (network *NetworkClass[T]) Receive() (msg T, ok bool) {
+	return network.inbox.Receive()
+}
 
-	// fmt.Println(network.nodeId, "Receive, ", network.queue)
-
-	// util.Logger.Println("net queue length is ", len(network.queue))
-	if len(network.queue) == 0 {
-		var t T
-		return t, false
-	}
-
-	msg = network.queue[0]
-	network.queue = network.queue[1:]
+func (network *NetworkClass[T]) ReceiveTimeout(d time.Duration) (msg T, ok bool) {
+	return network.inbox.ReceiveTimeout(d)
+}
 
-	// util.Logger.Println("In Receive(), received msg", msg)
-	return msg, true
+func (network *NetworkClass[T]) ReceiveContext(ctx context.Context) (T, error) {
+	return network.inbox.ReceiveContext(ctx)
+}
 
+func (network *NetworkClass[T]) Messages() <-chan T {
+	return network.inbox.Messages()
 }
 
-// handleConnection adds the msg to queue and closes the connection
-//   The network class does not check that the message is well-formed,
-//   and will add it to the queue for downstream processing
+// handleConnection decodes every msg on the stream and adds it to the
+//   queue until the sender closes the connection. The network class does
+//   not check that the message is well-formed, and will add it to the
+//   queue for downstream processing
 func (network *NetworkClass[T]) handleConnection(conn net.Conn) error {
 	defer conn.Close()
 
 	decoder := gob.NewDecoder(conn)
-	var msg T
-	err := decoder.Decode(&msg)
+	for {
+		var msg T
+		err := decoder.Decode(&msg)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			util.Logger.Println("Error in handleConnection:", err)
+			return err
+		}
 
-	if err == nil {
-		// TODO: Locking
-		network.queue = append(network.queue, msg)
+		network.inbox.Push(msg)
 		// util.Logger.Println("msg contains ", msg)
-	} else {
-		util.Logger.Println("Error in handleConnection:", err)
 	}
-
-	return err
 }
 
 func (network *NetworkClass[T]) handleConnectionUDP() error {
@@ -231,7 +433,7 @@ func (network *NetworkClass[T]) handleConnectionUDP() error {
 
 		err = decoder.Decode(&msg)
 		if err == nil {
-			network.queue = append(network.queue, msg)
+			network.inbox.Push(msg)
 		} else {
 			fmt.Println("err decoding", err, length)
 		}
@@ -1,6 +1,10 @@
 package network
 
-import "encoding/gob"
+import (
+	"context"
+	"encoding/gob"
+	"time"
+)
 
 // Network Interface
 type Network[T any] interface {
@@ -19,7 +23,24 @@ type Network[T any] interface {
 
 	Multicast(nodeIds []int, msg T) error
 
+	// SetNodeAddress adds nodeId to the node id table, or moves it to a
+	//   new address
+	SetNodeAddress(nodeId int, address string)
+
+	RemoveNode(nodeId int)
+
+	// Non-blocking, ok is false if nothing has arrived
 	Receive() (msg T, ok bool)
+
+	// Blocks for at most d waiting for a message
+	ReceiveTimeout(d time.Duration) (msg T, ok bool)
+
+	// Blocks until a message arrives or ctx is done
+	ReceiveContext(ctx context.Context) (T, error)
+
+	// Every message is delivered on the returned channel; do not mix with
+	//   the Receive* methods
+	Messages() <-chan T
 }
 
 type serializable interface {
@@ -13,7 +13,7 @@ func TestPairwiseMessages[T any]() {
 		1: "localhost:7004",
 		2: "localhost:7005"}
 
-	var nodeTable map[int]*NetworkClass[T] = createNodesFromTable[T](networkTable)
+	var nodeTable map[int]Network[T] = createNodesFromTable[T](networkTable)
 
 	fmt.Println(nodeTable)
 
@@ -33,9 +33,30 @@ func TestPairwiseMessages[T any]() {
 	sendAllPairwiseMessages(nodeTable)
 }
 
-func createNodesFromTable[T any](networkTable map[int]string) map[int]*NetworkClass[T] {
+// Same as TestPairwiseMessages, but over the in-process DumbNetwork hub
+func TestLocalPairwiseMessages[T any]() {
 
-	nodeTable := make(map[int]*NetworkClass[T])
+	hub := DumbNetwork[T]{}
+	hub.Initialize(3)
+
+	nodeTable := make(map[int]Network[T])
+	for nodeId := 0; nodeId < 3; nodeId++ {
+		endpoint := hub.Endpoint(nodeId)
+		endpoint.Initialize(nodeId, "", make([]T, 0), nil, "")
+		err := endpoint.Listen()
+		if err != nil {
+			fmt.Println("Error", err)
+		}
+		nodeTable[nodeId] = endpoint
+	}
+
+	fmt.Println("Sending pairwise Messages:")
+	sendAllPairwiseMessages(nodeTable)
+}
+
+func createNodesFromTable[T any](networkTable map[int]string) map[int]Network[T] {
+
+	nodeTable := make(map[int]Network[T])
 
 	for nodeId, address := range networkTable {
 		port := ":" + strings.Split(address, ":")[1]
@@ -50,7 +71,7 @@ func createNodesFromTable[T any](networkTable map[int]string) map[int]*NetworkCl
 }
 
 // Synchronized -- test that messages are being passed across all edges
-func sendAllPairwiseMessages[T any](nodeTable map[int]*NetworkClass[T]) {
+func sendAllPairwiseMessages[T any](nodeTable map[int]Network[T]) {
 
 	for srcId, srcNode := range nodeTable {
 		for dstId, dstNode := range nodeTable {
@@ -64,10 +85,9 @@ func sendAllPairwiseMessages[T any](nodeTable map[int]*NetworkClass[T]) {
 
 				srcNode.Send(dstId, msg)
 
-				time.Sleep(1 * time.Second)
 				// fmt.Println("getting message:")
 
-				recMsg, ok := dstNode.Receive()
+				recMsg, ok := dstNode.ReceiveTimeout(1 * time.Second)
 
 				if !ok {
 					fmt.Printf("dstNode %d has no messages\n", dstId)
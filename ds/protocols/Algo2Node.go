@@ -18,6 +18,8 @@ type Algo2Node struct {
 	ml            ml.MLProcess
 	net           network.Network[Algo2Message]
 	timeoutInSecs int
+	// kept short, Run is called between training batches
+	receiveTimeout time.Duration
 }
 
 func (node *Algo2Node) Initialize(id int, name string, mlp ml.MLProcess, net network.Network[Algo2Message], heartbeatNet network.Network[Algo2Message], numNodes int, leaderId int) {
@@ -26,6 +28,7 @@ func (node *Algo2Node) Initialize(id int, name string, mlp ml.MLProcess, net net
 	node.ml = mlp
 	node.net = net
 	node.timeoutInSecs = 2
+	node.receiveTimeout = 5 * time.Millisecond
 }
 
 func (node *Algo2Node) Run() {
@@ -43,13 +46,14 @@ func (node *Algo2Node) Run() {
 			util.Logger.Println("broadcasted")
 		}
 	}
-	msg, received := node.net.Receive()
+	// wait a moment for the first message instead of spinning, then drain
+	//   whatever else has arrived
+	msg, received := node.net.ReceiveTimeout(node.receiveTimeout)
 	for received {
 		util.Logger.Println("recieved from ", msg.Id)
-		time.Sleep(time.Second)
 		var grads ml.Gradients = msg.Grads
 		allGrads = append(allGrads, grads)
-		msg, received = node.net.Receive()
+		msg, received = node.net.ReceiveTimeout(0)
 	}
 	for _, grads := range allGrads {
 		node.ml.UpdateModel(grads)
@@ -0,0 +1,42 @@
+package protocols
+
+import (
+	"time"
+)
+
+// Nodes that order writes implement CommitStats so runs of different
+//   protocols can be compared. The latency is measured from the moment a
+//   node hands its own gradients to the protocol until it applies them.
+type CommitStats interface {
+	CommitLatency() (mean time.Duration, commits int)
+}
+
+type commitLatency struct {
+	sentAt map[int]time.Time
+	total  time.Duration
+	count  int
+}
+
+func (stats *commitLatency) sent(seq int, now time.Time) {
+	if stats.sentAt == nil {
+		stats.sentAt = make(map[int]time.Time)
+	}
+	stats.sentAt[seq] = now
+}
+
+func (stats *commitLatency) committed(seq int, now time.Time) {
+	sentAt, ok := stats.sentAt[seq]
+	if !ok {
+		return
+	}
+	delete(stats.sentAt, seq)
+	stats.total += now.Sub(sentAt)
+	stats.count++
+}
+
+func (stats *commitLatency) mean() (time.Duration, int) {
+	if stats.count == 0 {
+		return 0, 0
+	}
+	return stats.total / time.Duration(stats.count), stats.count
+}
@@ -0,0 +1,184 @@
+package protocols
+
+import (
+	"math"
+	"time"
+)
+
+// A FailureDetector turns heartbeat arrival times into a suspicion level
+//   per peer. The protocol reports every heartbeat it gets and asks the
+//   detector whether a peer is still available, instead of comparing the
+//   last heartbeat against a fixed timeout itself.
+type FailureDetector interface {
+	// Heartbeat records a heartbeat from nodeId at t. The first one starts
+	//   tracking the peer.
+	Heartbeat(nodeId int, t time.Time)
+	// Reset forgets what was learned about nodeId and starts tracking it
+	//   again as if a heartbeat had arrived at t
+	Reset(nodeId int, t time.Time)
+	Remove(nodeId int)
+	// Suspicion grows the longer nodeId has been silent, 0 means no doubt
+	Suspicion(nodeId int, now time.Time) float64
+	IsAvailable(nodeId int, now time.Time) bool
+}
+
+// TimeoutDetector suspects a peer once it has been silent for Timeout.
+//   Its suspicion is the fraction of the timeout that has passed.
+type TimeoutDetector struct {
+	Timeout time.Duration
+	last    map[int]time.Time
+}
+
+func MakeTimeoutDetector(timeout time.Duration) *TimeoutDetector {
+	return &TimeoutDetector{Timeout: timeout, last: make(map[int]time.Time)}
+}
+
+func (detector *TimeoutDetector) Heartbeat(nodeId int, t time.Time) {
+	detector.last[nodeId] = t
+}
+
+func (detector *TimeoutDetector) Reset(nodeId int, t time.Time) {
+	detector.last[nodeId] = t
+}
+
+func (detector *TimeoutDetector) Remove(nodeId int) {
+	delete(detector.last, nodeId)
+}
+
+func (detector *TimeoutDetector) Suspicion(nodeId int, now time.Time) float64 {
+	last, ok := detector.last[nodeId]
+	if !ok {
+		return math.Inf(1)
+	}
+	return float64(now.Sub(last)) / float64(detector.Timeout)
+}
+
+func (detector *TimeoutDetector) IsAvailable(nodeId int, now time.Time) bool {
+	return detector.Suspicion(nodeId, now) < 1
+}
+
+// PhiAccrualConfig configures a PhiAccrualDetector, see
+//   DefaultPhiAccrualConfig for sensible values
+type PhiAccrualConfig struct {
+	// a peer is suspected once phi reaches Threshold, phi = 8 means the
+	//   chance that it is still alive is about 1e-8
+	Threshold float64
+	// intervals remembered per peer
+	MaxSamples int
+	// a lower bound on the standard deviation, so a peer with very regular
+	//   heartbeats is not suspected after the first late one
+	MinStdDeviation time.Duration
+	// how much longer than usual a heartbeat may take before phi starts to
+	//   grow, this absorbs pauses and slow links
+	AcceptablePause time.Duration
+	// the interval assumed for a peer we have not heard from twice yet
+	FirstHeartbeatEstimate time.Duration
+}
+
+func DefaultPhiAccrualConfig() PhiAccrualConfig {
+	return PhiAccrualConfig{
+		Threshold:              8,
+		MaxSamples:             200,
+		MinStdDeviation:        100 * time.Millisecond,
+		AcceptablePause:        time.Second,
+		FirstHeartbeatEstimate: 500 * time.Millisecond,
+	}
+}
+
+// PhiAccrualDetector is the detector of Hayashibara et al., as used by
+//   Cassandra and Akka. It keeps a window of heartbeat inter-arrival times
+//   per peer and reports phi = -log10(P(a heartbeat arrives later than
+//   now)) under a normal distribution fitted to them, so a peer on a slow
+//   or jittery link is given more time than one on a fast link.
+type PhiAccrualDetector struct {
+	config PhiAccrualConfig
+	peers  map[int]*phiHistory
+}
+
+type phiHistory struct {
+	last      time.Time
+	intervals []float64
+	sum       float64
+	sumSq     float64
+}
+
+func MakePhiAccrualDetector(config PhiAccrualConfig) *PhiAccrualDetector {
+	return &PhiAccrualDetector{config: config, peers: make(map[int]*phiHistory)}
+}
+
+func (detector *PhiAccrualDetector) Heartbeat(nodeId int, t time.Time) {
+	history, ok := detector.peers[nodeId]
+	if !ok {
+		detector.Reset(nodeId, t)
+		return
+	}
+	if !t.After(history.last) {
+		return
+	}
+	history.add(float64(t.Sub(history.last)), detector.config.MaxSamples)
+	history.last = t
+}
+
+func (detector *PhiAccrualDetector) Reset(nodeId int, t time.Time) {
+	// start from two intervals around the estimate, like Akka
+	estimate := float64(detector.config.FirstHeartbeatEstimate)
+	history := &phiHistory{last: t}
+	history.add(estimate-estimate/4, detector.config.MaxSamples)
+	history.add(estimate+estimate/4, detector.config.MaxSamples)
+	detector.peers[nodeId] = history
+}
+
+func (detector *PhiAccrualDetector) Remove(nodeId int) {
+	delete(detector.peers, nodeId)
+}
+
+func (detector *PhiAccrualDetector) Suspicion(nodeId int, now time.Time) float64 {
+	history, ok := detector.peers[nodeId]
+	if !ok {
+		return math.Inf(1)
+	}
+	n := float64(len(history.intervals))
+	mean := history.sum / n
+	stdDev := math.Sqrt(math.Max(history.sumSq/n-mean*mean, 0))
+	stdDev = math.Max(stdDev, float64(detector.config.MinStdDeviation))
+	return phi(float64(now.Sub(history.last)), mean+float64(detector.config.AcceptablePause), stdDev)
+}
+
+func (detector *PhiAccrualDetector) IsAvailable(nodeId int, now time.Time) bool {
+	return detector.Suspicion(nodeId, now) < detector.config.Threshold
+}
+
+func (history *phiHistory) add(interval float64, maxSamples int) {
+	if len(history.intervals) >= maxSamples {
+		dropped := history.intervals[0]
+		history.intervals = history.intervals[1:]
+		history.sum -= dropped
+		history.sumSq -= dropped * dropped
+	}
+	history.intervals = append(history.intervals, interval)
+	history.sum += interval
+	history.sumSq += interval * interval
+}
+
+// phi uses the logistic approximation of the normal CDF from Akka
+func phi(elapsed float64, mean float64, stdDev float64) float64 {
+	y := (elapsed - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// SetFailureDetector replaces the phi accrual detector with the default
+//   config that decides when a zab node gives up on its leader or
+//   followers. Must be called before Run.
+func (node *ZabNode) SetFailureDetector(detector FailureDetector) {
+	node.detector = detector
+}
+
+// Suspicion returns how much this node suspects nodeId has failed, on the
+//   scale of its failure detector
+func (node *ZabNode) Suspicion(nodeId int) float64 {
+	return node.detector.Suspicion(nodeId, node.clock.Now())
+}
@@ -0,0 +1,77 @@
+package protocols
+
+import (
+	"bytes"
+	"encoding/gob"
+	"flads/ml"
+)
+
+// GradientStateMachine replicates a model: commands are encoded gradients
+//   that go to UpdateModel, and snapshots are the model's weights. When it
+//   has a source of hyperparameters it sets the learning rate before every
+//   update, from the committed config and the number of updates so far.
+type GradientStateMachine struct {
+	ml              ml.MLProcess
+	updates         int
+	hyperparameters func() (ml.Hyperparameters, bool)
+}
+
+type gradientState struct {
+	Weights ml.MLPWeights
+	Updates int
+}
+
+func MakeGradientStateMachine(mlp ml.MLProcess) *GradientStateMachine {
+	return &GradientStateMachine{ml: mlp}
+}
+
+// source has to be replicated in the same log as the gradients, so every
+//   replica sees a change at the same point
+func (sm *GradientStateMachine) SetHyperparameters(source func() (ml.Hyperparameters, bool)) {
+	sm.hyperparameters = source
+}
+
+func EncodeGradients(grads ml.Gradients) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(grads)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (sm *GradientStateMachine) Apply(command []byte) error {
+	var grads ml.Gradients
+	err := gob.NewDecoder(bytes.NewReader(command)).Decode(&grads)
+	if err != nil {
+		return err
+	}
+	if sm.hyperparameters != nil {
+		if h, ok := sm.hyperparameters(); ok {
+			sm.ml.SetLearningRate(h.LearningRateAt(sm.updates))
+		}
+	}
+	sm.ml.UpdateModel(grads)
+	sm.updates++
+	return nil
+}
+
+func (sm *GradientStateMachine) Snapshot() ([]byte, error) {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(gradientState{sm.ml.GetWeights(), sm.updates})
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (sm *GradientStateMachine) Restore(snapshot []byte) error {
+	var state gradientState
+	err := gob.NewDecoder(bytes.NewReader(snapshot)).Decode(&state)
+	if err != nil {
+		return err
+	}
+	sm.ml.SetWeights(state.Weights)
+	sm.updates = state.Updates
+	return nil
+}
@@ -0,0 +1,53 @@
+package protocols
+
+import (
+	"flads/ml"
+	"flads/util"
+)
+
+// The hyperparameters of the cluster live in the metadata store under
+//   HYPERPARAMETERS_KEY. The model is replicated in the same log, so a new
+//   learning rate or schedule takes effect at the same zxid everywhere, and
+//   a node that joins late gets the config with the rest of the snapshot.
+
+const HYPERPARAMETERS_KEY = "config/hyperparameters"
+
+// ProposeHyperparameters commits h unless some config was committed
+//   already. Either way the result holds the config the cluster agreed on.
+func ProposeHyperparameters(kv *KVStore, h ml.Hyperparameters) *KVResult {
+	return writeHyperparameters(kv, h, true)
+}
+
+// ChangeHyperparameters replaces the committed config, the new one applies
+//   from the first update after it commits
+func ChangeHyperparameters(kv *KVStore, h ml.Hyperparameters) *KVResult {
+	return writeHyperparameters(kv, h, false)
+}
+
+func writeHyperparameters(kv *KVStore, h ml.Hyperparameters, onlyFirst bool) *KVResult {
+	value, err := h.Encode()
+	if err == nil {
+		err = h.Validate()
+	}
+	if err != nil {
+		return &KVResult{Done: true, Err: err}
+	}
+	if onlyFirst {
+		return kv.CompareAndSwap(HYPERPARAMETERS_KEY, 0, value)
+	}
+	return kv.Put(HYPERPARAMETERS_KEY, value)
+}
+
+// CommittedHyperparameters reads the config this node has applied
+func CommittedHyperparameters(kv *KVStore) (ml.Hyperparameters, bool) {
+	value, _, ok := kv.Get(HYPERPARAMETERS_KEY)
+	if !ok {
+		return ml.Hyperparameters{}, false
+	}
+	h, err := ml.DecodeHyperparameters(value)
+	if err != nil {
+		util.Logger.Println("ignoring bad committed hyperparameters:", err)
+		return ml.Hyperparameters{}, false
+	}
+	return h, true
+}
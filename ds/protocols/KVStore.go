@@ -0,0 +1,309 @@
+package protocols
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"flads/util"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KVStore keeps cluster metadata such as the learning rate, the epoch every
+//   node is on or dataset assignments. It is a StateMachine, so every write
+//   goes through the commit path of the protocol replicating it and all
+//   nodes apply writes in the same order.
+//
+//   Writes return a KVResult that is filled in once the write is applied
+//   on this node. Get reads the local copy, which may lag behind the
+//   leader. SyncGet syncs with the leader first, so it sees every write
+//   that committed before it was called, without adding to the log.
+
+type KVOp string
+
+const (
+	KV_PUT = "KV_PUT"
+	KV_CAS = "KV_CAS"
+)
+
+var ErrKVResultLost = errors.New("operation was applied but its result is no longer known")
+
+// Version starts at 1 and goes up with every write to the key
+type KVEntry struct {
+	Value   []byte
+	Version int
+}
+
+type KVEvent struct {
+	Key     string
+	Value   []byte
+	Version int
+}
+
+// KVResult is filled in when its operation has been applied on this node.
+//   Value, Version and Found describe the key after the operation, Swapped
+//   whether a put or compare and swap wrote it.
+type KVResult struct {
+	Done    bool
+	Value   []byte
+	Version int
+	Found   bool
+	Swapped bool
+	Err     error
+}
+
+// KVClientId tells apart the stores that issue operations, Start tells
+//   restarts apart
+type KVClientId struct {
+	NodeId int
+	Start  int64
+}
+
+type kvCommand struct {
+	Op      KVOp
+	Key     string
+	Value   []byte
+	Version int
+	Client  KVClientId
+	OpId    int
+}
+
+// outcomes are part of the replicated state, so a node that catches up
+//   from a snapshot can still complete the operations it is waiting on
+type kvOutcome struct {
+	OpId    int
+	Swapped bool
+}
+
+type kvState struct {
+	Entries  map[string]KVEntry
+	Outcomes map[KVClientId][]kvOutcome
+}
+
+type kvPending struct {
+	key    string
+	result *KVResult
+}
+
+type kvWatch struct {
+	prefix   string
+	callback func(KVEvent)
+}
+
+type KVStore struct {
+	state       kvState
+	maxOutcomes int
+
+	nodeId   int
+	client   KVClientId
+	submit   func(command []byte)
+	sync     func(done func())
+	now      func() time.Time
+	nextOpId int
+	pending  map[int]*kvPending
+
+	watches     map[int]kvWatch
+	nextWatchId int
+}
+
+// submit hands a command to the protocol, sync calls done once everything
+//   committed before the call has been applied here. now is only used to
+//   tell restarts of this node apart.
+func MakeKVStore(nodeId int, submit func(command []byte), sync func(done func()), now func() time.Time) *KVStore {
+	return &KVStore{
+		state:       kvState{make(map[string]KVEntry), make(map[KVClientId][]kvOutcome)},
+		maxOutcomes: 64,
+		nodeId:      nodeId,
+		submit:      submit,
+		sync:        sync,
+		now:         now,
+		pending:     make(map[int]*kvPending),
+		watches:     make(map[int]kvWatch),
+	}
+}
+
+/****************************************************************************************************/
+/***************************************Client*******************************************************/
+/****************************************************************************************************/
+
+// Get reads our local copy of key, which may be stale
+func (store *KVStore) Get(key string) ([]byte, int, bool) {
+	entry, ok := store.state.Entries[key]
+	return append([]byte{}, entry.Value...), entry.Version, ok
+}
+
+func (store *KVStore) Put(key string, value []byte) *KVResult {
+	return store.send(kvCommand{Op: KV_PUT, Key: key, Value: value})
+}
+
+// CompareAndSwap writes value only if key is still at version, 0 meaning
+//   the key does not exist yet
+func (store *KVStore) CompareAndSwap(key string, version int, value []byte) *KVResult {
+	return store.send(kvCommand{Op: KV_CAS, Key: key, Value: value, Version: version})
+}
+
+// SyncGet reads key once everything that committed before the call has
+//   been applied here
+func (store *KVStore) SyncGet(key string) *KVResult {
+	result := &KVResult{}
+	store.sync(func() {
+		store.fill(result, key, false, nil)
+	})
+	return result
+}
+
+// Watch calls callback for every write to a key under prefix, on every
+//   node, as the write is applied. It returns an id for Unwatch.
+func (store *KVStore) Watch(prefix string, callback func(KVEvent)) int {
+	store.nextWatchId++
+	store.watches[store.nextWatchId] = kvWatch{prefix, callback}
+	return store.nextWatchId
+}
+
+func (store *KVStore) Unwatch(id int) {
+	delete(store.watches, id)
+}
+
+func (store *KVStore) send(command kvCommand) *KVResult {
+	if store.nextOpId == 0 {
+		store.client = KVClientId{store.nodeId, store.now().UnixNano()}
+	}
+	store.nextOpId++
+	command.Client = store.client
+	command.OpId = store.nextOpId
+
+	result := &KVResult{}
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(command); err != nil {
+		result.Done = true
+		result.Err = err
+		return result
+	}
+	store.pending[command.OpId] = &kvPending{command.Key, result}
+	store.submit(buffer.Bytes())
+	return result
+}
+
+func (store *KVStore) complete(opId int, swapped bool, err error) {
+	pending, ok := store.pending[opId]
+	if !ok {
+		return
+	}
+	delete(store.pending, opId)
+	store.fill(pending.result, pending.key, swapped, err)
+}
+
+func (store *KVStore) fill(result *KVResult, key string, swapped bool, err error) {
+	entry, found := store.state.Entries[key]
+	result.Value = append([]byte{}, entry.Value...)
+	result.Version = entry.Version
+	result.Found = found
+	result.Swapped = swapped
+	result.Err = err
+	result.Done = true
+}
+
+func (store *KVStore) notify(key string) {
+	entry := store.state.Entries[key]
+	for _, id := range sortedKeys(store.watches) {
+		if watch := store.watches[id]; strings.HasPrefix(key, watch.prefix) {
+			watch.callback(KVEvent{key, append([]byte{}, entry.Value...), entry.Version})
+		}
+	}
+}
+
+/****************************************************************************************************/
+/***************************************State machine************************************************/
+/****************************************************************************************************/
+
+func (store *KVStore) Apply(command []byte) error {
+	var op kvCommand
+	err := gob.NewDecoder(bytes.NewReader(command)).Decode(&op)
+	if err != nil {
+		return err
+	}
+
+	swapped := false
+	entry := store.state.Entries[op.Key]
+	switch op.Op {
+	case KV_PUT:
+		swapped = true
+	case KV_CAS:
+		swapped = entry.Version == op.Version
+	}
+	if swapped {
+		store.state.Entries[op.Key] = KVEntry{op.Value, entry.Version + 1}
+	}
+
+	outcomes := append(store.state.Outcomes[op.Client], kvOutcome{op.OpId, swapped})
+	if len(outcomes) > store.maxOutcomes {
+		outcomes = outcomes[len(outcomes)-store.maxOutcomes:]
+	}
+	store.state.Outcomes[op.Client] = outcomes
+
+	if op.Client == store.client {
+		store.complete(op.OpId, swapped, nil)
+	}
+	if swapped {
+		store.notify(op.Key)
+	}
+	return nil
+}
+
+func (store *KVStore) Snapshot() ([]byte, error) {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(store.state)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Restore fires watches for every key the snapshot changes, and completes
+//   the operations it covers
+func (store *KVStore) Restore(snapshot []byte) error {
+	var state kvState
+	err := gob.NewDecoder(bytes.NewReader(snapshot)).Decode(&state)
+	if err != nil {
+		return err
+	}
+	if state.Entries == nil {
+		state.Entries = make(map[string]KVEntry)
+	}
+	if state.Outcomes == nil {
+		state.Outcomes = make(map[KVClientId][]kvOutcome)
+	}
+	old := store.state
+	store.state = state
+
+	outcomes := state.Outcomes[store.client]
+	for _, opId := range sortedKeys(store.pending) {
+		if len(outcomes) == 0 || opId > outcomes[len(outcomes)-1].OpId {
+			continue
+		}
+		lost := true
+		for _, outcome := range outcomes {
+			if outcome.OpId == opId {
+				store.complete(opId, outcome.Swapped, nil)
+				lost = false
+			}
+		}
+		if lost {
+			util.Logger.Println("lost the result of kv operation", opId)
+			store.complete(opId, false, ErrKVResultLost)
+		}
+	}
+
+	keys := make([]string, 0)
+	for key, entry := range state.Entries {
+		if old.Entries[key].Version != entry.Version {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		store.notify(key)
+	}
+	return nil
+}
@@ -3,9 +3,27 @@ package protocols
 import (
 	"flads/ds/network"
 	"flads/ml"
+	"flads/util"
+	"sort"
 )
 
-type Node[T any] interface {
-	Initialize(id int, name string, mlp ml.MLProcess, net network.Network[T], heartbeatNet network.Network[T], numNodes int, leaderId int)
+// T is the protocol message type and H the heartbeat message type
+type Node[T any, H any] interface {
+	Initialize(id int, name string, mlp ml.MLProcess, net network.Network[T], heartbeatNet network.Network[H], numNodes int, leaderId int)
 	Run()
 }
+
+// Nodes that keep time implement Clocked so a simulation can hand them a
+//   virtual clock before they start running
+type Clocked interface {
+	SetClock(clock util.Clock)
+}
+
+func sortedKeys[V any](m map[int]V) []int {
+	keys := make([]int, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	return keys
+}
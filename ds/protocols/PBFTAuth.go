@@ -0,0 +1,203 @@
+package protocols
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"flads/ml"
+	"flads/util"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+)
+
+// Every PBFT message is signed by its sender with ed25519, and every
+//   request by the node that made it, so nobody can speak for someone else
+//   by setting SenderId. MACs would be cheaper, but view changes forward
+//   prepares and checkpoints of other nodes, and those have to stay
+//   verifiable by whoever receives them.
+//   Signatures cover a digest we compute ourselves rather than a gob
+//   encoding, gob type ids depend on the order a process first sees types.
+
+type PBFTDigest [sha256.Size]byte
+
+type PBFTKeys struct {
+	Private ed25519.PrivateKey
+	Public  map[int]ed25519.PublicKey
+}
+
+// MakeTestPBFTKeys derives every key from the node ids, so anyone can
+//   forge them. Only meant for simulations, and for local runs that ask
+//   for them with -insecureTestKeys.
+func MakeTestPBFTKeys(id int, numNodes int) *PBFTKeys {
+	keys := &PBFTKeys{Public: make(map[int]ed25519.PublicKey)}
+	for i := 0; i < numNodes; i++ {
+		seed := sha256.Sum256([]byte(fmt.Sprintf("flads-pbft-test-key-%d", i)))
+		private := ed25519.NewKeyFromSeed(seed[:])
+		keys.Public[i] = private.Public().(ed25519.PublicKey)
+		if i == id {
+			keys.Private = private
+		}
+	}
+	return keys
+}
+
+// GeneratePBFTKeys writes a key pair per node to dir, as <id>.key and
+//   <id>.pub. Every node needs all the .pub files but only its own .key.
+func GeneratePBFTKeys(dir string, numNodes int) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i := 0; i < numNodes; i++ {
+		public, private, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.key", i)), private.Seed(), 0600)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.pub", i)), public, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func LoadPBFTKeys(dir string, id int, numNodes int) (*PBFTKeys, error) {
+	keys := &PBFTKeys{Public: make(map[int]ed25519.PublicKey)}
+	for i := 0; i < numNodes; i++ {
+		public, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("%d.pub", i)))
+		if err != nil {
+			return nil, err
+		}
+		if len(public) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("bad public key for node %d", i)
+		}
+		keys.Public[i] = public
+	}
+
+	seed, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("%d.key", id)))
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("bad private key for node %d", id)
+	}
+	keys.Private = ed25519.NewKeyFromSeed(seed)
+	return keys, nil
+}
+
+type pbftHasher struct {
+	hash.Hash
+}
+
+func (h pbftHasher) int(v int) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	h.Write(b[:])
+}
+
+func (h pbftHasher) bytes(b []byte) {
+	h.int(len(b))
+	h.Write(b)
+}
+
+// nested messages are covered by their own digest and signature
+func (h pbftHasher) message(msg *PBFTMessage) {
+	digest := msg.digest()
+	h.Write(digest[:])
+	h.bytes(msg.Signature)
+}
+
+func (h pbftHasher) sum() PBFTDigest {
+	var digest PBFTDigest
+	copy(digest[:], h.Sum(nil))
+	return digest
+}
+
+// The digest of a request is also what identifies it
+func (request *PBFTRequest) digest() PBFTDigest {
+	h := pbftHasher{sha256.New()}
+	h.int(request.Origin)
+	h.int(request.ReqSeq)
+	if err := ml.HashGradients(h, request.Grads); err != nil {
+		util.Logger.Println("failed to hash gradients:", err)
+	}
+	return h.sum()
+}
+
+// The Request of a PRE_PREPARE is not hashed, msg.Digest already binds it
+func (msg *PBFTMessage) digest() PBFTDigest {
+	h := pbftHasher{sha256.New()}
+	h.int(msg.SenderId)
+	h.bytes([]byte(msg.MsgType))
+	h.int(msg.View)
+	h.int(msg.Seq)
+	h.Write(msg.Digest[:])
+
+	h.int(len(msg.Checkpoint))
+	for i := range msg.Checkpoint {
+		h.message(&msg.Checkpoint[i])
+	}
+	h.int(len(msg.Prepared))
+	for i := range msg.Prepared {
+		h.message(&msg.Prepared[i].PrePrepare)
+		h.int(len(msg.Prepared[i].Prepares))
+		for j := range msg.Prepared[i].Prepares {
+			h.message(&msg.Prepared[i].Prepares[j])
+		}
+	}
+	h.int(len(msg.ViewChanges))
+	for i := range msg.ViewChanges {
+		h.message(&msg.ViewChanges[i])
+	}
+	h.int(len(msg.PrePrepares))
+	for i := range msg.PrePrepares {
+		h.message(&msg.PrePrepares[i])
+	}
+	h.int(len(msg.Executed))
+	for _, executed := range msg.Executed {
+		h.int(executed.Seq)
+		digest := executed.digest()
+		h.Write(digest[:])
+	}
+	return h.sum()
+}
+
+func (node *PBFTNode) sign(msg *PBFTMessage) {
+	msg.SenderId = node.id
+	digest := msg.digest()
+	msg.Signature = ed25519.Sign(node.keys.Private, digest[:])
+}
+
+func (node *PBFTNode) verify(msg *PBFTMessage) bool {
+	public, ok := node.keys.Public[msg.SenderId]
+	if !ok {
+		return false
+	}
+	digest := msg.digest()
+	return ed25519.Verify(public, digest[:], msg.Signature)
+}
+
+// verifyRequest checks the origin signed the request and returns its
+//   digest. A nil request is the null request of a view change.
+func (node *PBFTNode) verifyRequest(request *PBFTRequest) (PBFTDigest, bool) {
+	if request == nil {
+		return PBFTDigest{}, true
+	}
+	public, ok := node.keys.Public[request.Origin]
+	if !ok {
+		return PBFTDigest{}, false
+	}
+	digest := request.digest()
+	return digest, ed25519.Verify(public, digest[:], request.Signature)
+}
+
+func (node *PBFTNode) signRequest(request *PBFTRequest) PBFTDigest {
+	digest := request.digest()
+	request.Signature = ed25519.Sign(node.keys.Private, digest[:])
+	return digest
+}
@@ -0,0 +1,188 @@
+package protocols
+
+import (
+	"flads/util"
+	"fmt"
+)
+
+// Every checkpointInterval requests a node broadcasts the digest of what it
+//   executed so far. Once a quorum agrees on a checkpoint it is stable: the
+//   log below it is dropped and the window of sequence numbers we accept
+//   moves up. A node that fell behind asks the others for what they
+//   executed, and takes a request once f+1 of them agree on it, so at
+//   least one honest node vouches for every request it applies.
+
+// PBFTExecuted is a request a node executed, Request is nil for a null one
+type PBFTExecuted struct {
+	Seq     int
+	Request *PBFTRequest
+}
+
+func (executed *PBFTExecuted) digest() PBFTDigest {
+	if executed.Request == nil {
+		return PBFTDigest{}
+	}
+	return executed.Request.digest()
+}
+
+func (node *PBFTNode) sendCheckpoint() {
+	checkpoint := PBFTMessage{MsgType: PBFT_CHECKPOINT, Seq: node.lastExecuted, Digest: node.stateDigest}
+	node.sign(&checkpoint)
+	node.broadcast(checkpoint)
+	node.handleCheckpoint(&checkpoint)
+}
+
+func (node *PBFTNode) handleCheckpoint(msg *PBFTMessage) {
+	if msg.Seq <= node.stableSeq {
+		return
+	}
+	if msg.Seq > node.highestSeen {
+		node.highestSeen = msg.Seq
+	}
+	if _, ok := node.checkpoints[msg.Seq]; !ok {
+		node.checkpoints[msg.Seq] = make(map[int]PBFTMessage)
+	}
+	node.checkpoints[msg.Seq][msg.SenderId] = *msg
+
+	proof := matching(node.checkpoints[msg.Seq], 0, msg.Digest)
+	if len(proof) >= node.quorum {
+		own, ok := node.checkpoints[msg.Seq][node.id]
+		if ok && own.Digest != msg.Digest {
+			fmt.Println("pbft node", node.id, "executed something else than a quorum up to", msg.Seq)
+		}
+		node.makeStable(msg.Seq, proof)
+	}
+}
+
+func (node *PBFTNode) validCheckpointProof(seq int, proof []PBFTMessage) bool {
+	if seq == 0 {
+		return true
+	}
+	if len(proof) == 0 {
+		return false
+	}
+	senders := make(map[int]bool)
+	for i := range proof {
+		checkpoint := &proof[i]
+		if checkpoint.MsgType != PBFT_CHECKPOINT || checkpoint.Seq != seq || checkpoint.Digest != proof[0].Digest {
+			return false
+		}
+		if !node.verify(checkpoint) {
+			return false
+		}
+		senders[checkpoint.SenderId] = true
+	}
+	return len(senders) >= node.quorum
+}
+
+// makeStable does not need us to have executed up to seq, if we have not
+//   we fetch it
+func (node *PBFTNode) makeStable(seq int, proof []PBFTMessage) {
+	if seq <= node.stableSeq {
+		return
+	}
+	node.stableSeq = seq
+	node.stableProof = proof
+	node.lowWatermark = seq
+	if seq > node.highestSeen {
+		node.highestSeen = seq
+	}
+	for slotSeq := range node.slots {
+		if slotSeq <= seq {
+			delete(node.slots, slotSeq)
+		}
+	}
+	for checkpointSeq := range node.checkpoints {
+		if checkpointSeq <= seq {
+			delete(node.checkpoints, checkpointSeq)
+		}
+	}
+}
+
+/****************************************************************************************************/
+/***************************************Fetch********************************************************/
+/****************************************************************************************************/
+
+func (node *PBFTNode) maybeFetch() {
+	if node.highestSeen <= node.lastExecuted {
+		return
+	}
+	// below a stable checkpoint nothing but a fetch gets us going again
+	now := node.clock.Now()
+	stuck := now.Sub(node.progressAt) >= node.fetchInterval || node.lastExecuted < node.stableSeq
+	if !stuck || now.Sub(node.lastFetch) < node.fetchInterval {
+		return
+	}
+	node.lastFetch = now
+	fetch := PBFTMessage{MsgType: PBFT_FETCH, Seq: node.lastExecuted}
+	node.sign(&fetch)
+	node.broadcast(fetch)
+}
+
+func (node *PBFTNode) handleFetch(msg *PBFTMessage) {
+	if len(node.executedLog) == 0 || msg.Seq >= node.lastExecuted {
+		return
+	}
+	start := msg.Seq + 1 - node.executedLog[0].Seq
+	if start < 0 {
+		util.Logger.Println("node", msg.SenderId, "is too far behind to fetch from us")
+		return
+	}
+	end := start + node.maxFetch
+	if end > len(node.executedLog) {
+		end = len(node.executedLog)
+	}
+
+	reply := PBFTMessage{MsgType: PBFT_FETCH_REPLY, Executed: append([]PBFTExecuted{}, node.executedLog[start:end]...)}
+	node.sign(&reply)
+	err := node.net.Send(msg.SenderId, reply)
+	if err != nil {
+		util.Logger.Println("failed to send fetched requests to", msg.SenderId, err)
+	}
+}
+
+func (node *PBFTNode) handleFetchReply(msg *PBFTMessage) {
+	for _, executed := range msg.Executed {
+		if executed.Seq <= node.lastExecuted {
+			continue
+		}
+		digest, ok := node.verifyRequest(executed.Request)
+		if !ok {
+			util.Logger.Println("dropping a fetched request with a bad signature from", msg.SenderId)
+			continue
+		}
+		votes, ok := node.fetched[executed.Seq]
+		if !ok {
+			votes = make(map[PBFTDigest]map[int]bool)
+			node.fetched[executed.Seq] = votes
+		}
+		if _, ok := votes[digest]; !ok {
+			votes[digest] = make(map[int]bool)
+		}
+		votes[digest][msg.SenderId] = true
+		node.fetchedRequests[digest] = executed.Request
+	}
+	node.executeReady()
+}
+
+// fetchedDigest returns the request f+1 nodes say they executed at seq
+func (node *PBFTNode) fetchedDigest(seq int) (PBFTDigest, bool) {
+	for digest, senders := range node.fetched[seq] {
+		if len(senders) >= node.f+1 {
+			return digest, true
+		}
+	}
+	return PBFTDigest{}, false
+}
+
+func (node *PBFTNode) clearFetched() {
+	for seq, votes := range node.fetched {
+		if seq > node.lastExecuted {
+			continue
+		}
+		for digest := range votes {
+			delete(node.fetchedRequests, digest)
+		}
+		delete(node.fetched, seq)
+	}
+}
@@ -0,0 +1,601 @@
+package protocols
+
+import (
+	"crypto/sha256"
+	"flads/ds/network"
+	"flads/ml"
+	"flads/util"
+	"fmt"
+	"time"
+)
+
+// PBFTNode orders gradient updates with PBFT, so up to f of 3f+1 nodes may
+//   be malicious. Every node signs its gradients and broadcasts them as a
+//   request, the primary of the current view gives each request a sequence
+//   number with PRE_PREPARE, and requests are applied with UpdateModel in
+//   sequence order once a quorum prepared and committed them.
+//   Backups that wait too long on a request vote the primary out with a
+//   view change (PBFTViewChange.go), and nodes agree on checkpoints to
+//   bound the log (PBFTCheckpoint.go). heartbeatNet is not used.
+
+type PBFTMsgType string
+
+const (
+	PBFT_REQUEST     = "PBFT_REQUEST"
+	PBFT_PRE_PREPARE = "PBFT_PRE_PREPARE"
+	PBFT_PREPARE     = "PBFT_PREPARE"
+	PBFT_COMMIT      = "PBFT_COMMIT"
+	PBFT_CHECKPOINT  = "PBFT_CHECKPOINT"
+	PBFT_VIEW_CHANGE = "PBFT_VIEW_CHANGE"
+	PBFT_NEW_VIEW    = "PBFT_NEW_VIEW"
+	PBFT_FETCH       = "PBFT_FETCH"
+	PBFT_FETCH_REPLY = "PBFT_FETCH_REPLY"
+)
+
+// A request carries the signature of its origin, so the primary cannot
+//   make up gradients. The digest of a request identifies it.
+type PBFTRequest struct {
+	Origin    int
+	ReqSeq    int
+	Grads     ml.Gradients
+	Signature []byte
+}
+
+type PBFTMessage struct {
+	SenderId int
+	MsgType  PBFTMsgType
+	View     int
+	Seq      int
+	Digest   PBFTDigest
+
+	// PBFT_REQUEST and PBFT_PRE_PREPARE, nil in the pre-prepare of a null
+	//   request
+	Request *PBFTRequest
+
+	// PBFT_VIEW_CHANGE: Seq is our stable checkpoint, Checkpoint its proof
+	Checkpoint []PBFTMessage
+	Prepared   []PBFTPrepared
+
+	// PBFT_NEW_VIEW
+	ViewChanges []PBFTMessage
+	PrePrepares []PBFTMessage
+
+	// PBFT_FETCH_REPLY
+	Executed []PBFTExecuted
+
+	Signature []byte
+}
+
+// PBFTPrepared proves a request prepared at PrePrepare.Seq
+type PBFTPrepared struct {
+	PrePrepare PBFTMessage
+	Prepares   []PBFTMessage
+}
+
+type pbftSlot struct {
+	view       int
+	digest     PBFTDigest
+	request    *PBFTRequest
+	prePrepare *PBFTMessage
+	prepares   map[int]PBFTMessage
+	commits    map[int]PBFTMessage
+	sentCommit bool
+	committed  bool
+	// the newest certificate, kept across views for view changes
+	prepared *PBFTPrepared
+}
+
+type pbftWaiting struct {
+	request PBFTRequest
+	digest  PBFTDigest
+	since   time.Time
+}
+
+type pbftOutstanding struct {
+	msg    PBFTMessage
+	sentAt time.Time
+}
+
+type PBFTNode struct {
+	id       int
+	numNodes int
+	name     string
+	ml       ml.MLProcess
+	net      network.Network[PBFTMessage]
+	clock    util.Clock
+	keys     *PBFTKeys
+
+	f      int
+	quorum int
+
+	view         int
+	viewChanging bool
+	seq          int // last sequence number we assigned as primary
+	slots        map[int]*pbftSlot
+	future       []PBFTMessage
+	lowWatermark int
+	logWindow    int
+
+	lastExecuted   int
+	stateDigest    PBFTDigest
+	executedReqSeq map[int]int
+	progressAt     time.Time
+
+	// requests we have seen but not executed, in arrival order
+	waiting    []pbftWaiting
+	waitingSet map[PBFTDigest]bool
+	// primary only
+	assigned       map[PBFTDigest]bool
+	assignedReqSeq map[int]int
+
+	// our own requests
+	nextReqSeq  int
+	outstanding map[int]*pbftOutstanding
+
+	checkpointInterval int
+	checkpoints        map[int]map[int]PBFTMessage
+	stableSeq          int
+	stableProof        []PBFTMessage
+	executedLog        []PBFTExecuted
+	retain             int
+
+	// the newest view change of every node
+	viewChanges       map[int]PBFTMessage
+	viewChangeStarted time.Time
+	viewChangeWait    time.Duration
+	lastNewView       *PBFTMessage
+
+	fetched         map[int]map[PBFTDigest]map[int]bool
+	fetchedRequests map[PBFTDigest]*PBFTRequest
+	highestSeen     int
+	lastFetch       time.Time
+
+	requestTimeout    time.Duration
+	viewChangeTimeout time.Duration
+	fetchInterval     time.Duration
+	receiveTimeout    time.Duration
+	maxFetch          int
+	latency           commitLatency
+}
+
+func (node *PBFTNode) Initialize(id int, name string, mlp ml.MLProcess, net network.Network[PBFTMessage], heartbeatNet network.Network[PBFTMessage], numNodes int, leaderId int) {
+	node.id = id
+	node.numNodes = numNodes
+	node.name = name
+	node.ml = mlp
+	node.net = net
+	node.clock = util.SystemClock
+
+	// with 3f+1 nodes this is 2f+1, any two quorums share an honest node
+	node.f = (numNodes - 1) / 3
+	node.quorum = (numNodes+node.f)/2 + 1
+
+	node.view = 0
+	node.slots = make(map[int]*pbftSlot)
+	node.logWindow = 200
+	node.executedReqSeq = make(map[int]int)
+	node.waitingSet = make(map[PBFTDigest]bool)
+	node.assigned = make(map[PBFTDigest]bool)
+	node.assignedReqSeq = make(map[int]int)
+	node.outstanding = make(map[int]*pbftOutstanding)
+
+	node.checkpointInterval = 20
+	node.checkpoints = make(map[int]map[int]PBFTMessage)
+	node.retain = 512
+
+	node.viewChanges = make(map[int]PBFTMessage)
+	node.fetched = make(map[int]map[PBFTDigest]map[int]bool)
+	node.fetchedRequests = make(map[PBFTDigest]*PBFTRequest)
+
+	node.requestTimeout = 2 * time.Second
+	node.viewChangeTimeout = 2 * time.Second
+	node.viewChangeWait = node.viewChangeTimeout
+	node.fetchInterval = 500 * time.Millisecond
+	node.receiveTimeout = 50 * time.Millisecond
+	node.maxFetch = 64
+	node.progressAt = node.clock.Now()
+}
+
+// SetKeys installs the keys the node signs and verifies with. A node
+//   without keys refuses to run. Must be called before Run.
+func (node *PBFTNode) SetKeys(keys *PBFTKeys) {
+	node.keys = keys
+}
+
+func (node *PBFTNode) SetClock(clock util.Clock) {
+	node.clock = clock
+	node.progressAt = clock.Now()
+}
+
+func (node *PBFTNode) CommitLatency() (time.Duration, int) {
+	return node.latency.mean()
+}
+
+func (node *PBFTNode) primary(view int) int {
+	return view % node.numNodes
+}
+
+func (node *PBFTNode) isPrimary() bool {
+	return node.primary(node.view) == node.id
+}
+
+func (node *PBFTNode) Run() {
+	if node.keys == nil {
+		util.Logger.Println("pbft node", node.id, "has no keys, not running")
+		return
+	}
+	if ready, localGrads := node.ml.GetGradients(); ready {
+		node.submit(localGrads)
+	}
+
+	msg, received := node.net.ReceiveTimeout(node.receiveTimeout)
+	for received {
+		node.handle(&msg)
+		msg, received = node.net.ReceiveTimeout(0)
+	}
+
+	if node.isPrimary() && !node.viewChanging {
+		node.assignRequests()
+	}
+	node.checkTimers()
+	node.maybeFetch()
+}
+
+func (node *PBFTNode) handle(msg *PBFTMessage) {
+	if !node.verify(msg) {
+		util.Logger.Println("dropping", msg.MsgType, "with a bad signature from", msg.SenderId)
+		return
+	}
+
+	switch msg.MsgType {
+	case PBFT_REQUEST:
+		node.handleRequest(msg)
+	case PBFT_PRE_PREPARE, PBFT_PREPARE, PBFT_COMMIT:
+		if msg.View > node.view || (msg.View == node.view && node.viewChanging) {
+			node.deferMessage(msg)
+		} else if msg.View == node.view {
+			node.handleNormal(msg)
+		}
+	case PBFT_CHECKPOINT:
+		node.handleCheckpoint(msg)
+	case PBFT_VIEW_CHANGE:
+		node.handleViewChange(msg)
+	case PBFT_NEW_VIEW:
+		node.handleNewView(msg)
+	case PBFT_FETCH:
+		node.handleFetch(msg)
+	case PBFT_FETCH_REPLY:
+		node.handleFetchReply(msg)
+	}
+}
+
+func (node *PBFTNode) handleNormal(msg *PBFTMessage) {
+	switch msg.MsgType {
+	case PBFT_PRE_PREPARE:
+		node.acceptPrePrepare(msg)
+	case PBFT_PREPARE:
+		node.handlePrepare(msg)
+	case PBFT_COMMIT:
+		node.handleCommit(msg)
+	}
+}
+
+// messages of a view we have not entered yet are replayed once we do
+func (node *PBFTNode) deferMessage(msg *PBFTMessage) {
+	if len(node.future) >= 4*node.logWindow*node.numNodes {
+		node.future = node.future[1:]
+	}
+	node.future = append(node.future, *msg)
+}
+
+func (node *PBFTNode) broadcast(msg PBFTMessage) {
+	err := node.net.BroadcastToRest(msg)
+	if err != nil {
+		util.Logger.Println("failed to broadcast", msg.MsgType, err)
+	}
+}
+
+/****************************************************************************************************/
+/***************************************Requests*****************************************************/
+/****************************************************************************************************/
+
+func (node *PBFTNode) submit(grads ml.Gradients) {
+	node.nextReqSeq++
+	request := PBFTRequest{Origin: node.id, ReqSeq: node.nextReqSeq, Grads: grads}
+	digest := node.signRequest(&request)
+
+	msg := PBFTMessage{MsgType: PBFT_REQUEST, Digest: digest, Request: &request}
+	node.sign(&msg)
+	now := node.clock.Now()
+	node.latency.sent(request.ReqSeq, now)
+	node.outstanding[request.ReqSeq] = &pbftOutstanding{msg, now}
+	node.broadcast(msg)
+	node.handleRequest(&msg)
+}
+
+func (node *PBFTNode) handleRequest(msg *PBFTMessage) {
+	if msg.Request == nil {
+		return
+	}
+	digest, ok := node.verifyRequest(msg.Request)
+	if !ok || digest != msg.Digest {
+		util.Logger.Println("dropping a request with a bad signature from", msg.SenderId)
+		return
+	}
+	if msg.Request.ReqSeq <= node.executedReqSeq[msg.Request.Origin] || node.waitingSet[digest] {
+		return
+	}
+	node.waiting = append(node.waiting, pbftWaiting{*msg.Request, digest, node.clock.Now()})
+	node.waitingSet[digest] = true
+}
+
+func (node *PBFTNode) removeWaiting(digest PBFTDigest) {
+	if !node.waitingSet[digest] {
+		return
+	}
+	delete(node.waitingSet, digest)
+	for i := range node.waiting {
+		if node.waiting[i].digest == digest {
+			node.waiting = append(node.waiting[:i], node.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// assignRequests pre-prepares waiting requests in the order each origin
+//   made them, as far as the log window allows
+func (node *PBFTNode) assignRequests() {
+	progress := true
+	for progress {
+		progress = false
+		for i := range node.waiting {
+			waiting := &node.waiting[i]
+			origin := waiting.request.Origin
+			if node.assigned[waiting.digest] {
+				continue
+			}
+			next := node.executedReqSeq[origin]
+			if node.assignedReqSeq[origin] > next {
+				next = node.assignedReqSeq[origin]
+			}
+			if waiting.request.ReqSeq != next+1 {
+				continue
+			}
+			if node.seq+1 > node.lowWatermark+node.logWindow {
+				return
+			}
+
+			node.seq++
+			node.assigned[waiting.digest] = true
+			node.assignedReqSeq[origin] = waiting.request.ReqSeq
+			request := waiting.request
+			prePrepare := PBFTMessage{
+				MsgType: PBFT_PRE_PREPARE,
+				View:    node.view,
+				Seq:     node.seq,
+				Digest:  waiting.digest,
+				Request: &request,
+			}
+			node.sign(&prePrepare)
+			node.broadcast(prePrepare)
+			node.acceptPrePrepare(&prePrepare)
+			progress = true
+		}
+	}
+}
+
+/****************************************************************************************************/
+/***************************************Normal case**************************************************/
+/****************************************************************************************************/
+
+func (node *PBFTNode) inWindow(seq int) bool {
+	return seq > node.lowWatermark && seq <= node.lowWatermark+node.logWindow
+}
+
+func (node *PBFTNode) slot(seq int) *pbftSlot {
+	slot, ok := node.slots[seq]
+	if !ok {
+		slot = &pbftSlot{
+			prepares: make(map[int]PBFTMessage),
+			commits:  make(map[int]PBFTMessage),
+		}
+		node.slots[seq] = slot
+	}
+	return slot
+}
+
+func (node *PBFTNode) acceptPrePrepare(msg *PBFTMessage) {
+	if msg.SenderId != node.primary(msg.View) || !node.inWindow(msg.Seq) {
+		return
+	}
+	digest, ok := node.verifyRequest(msg.Request)
+	if !ok || digest != msg.Digest {
+		util.Logger.Println("dropping a pre-prepare for", msg.Seq, "with a bad request from", msg.SenderId)
+		return
+	}
+
+	slot := node.slot(msg.Seq)
+	if slot.prePrepare != nil && slot.view == msg.View {
+		if slot.digest != msg.Digest {
+			util.Logger.Println("primary", msg.SenderId, "sent conflicting pre-prepares for", msg.Seq)
+		}
+		return
+	}
+	prePrepare := *msg
+	slot.view = msg.View
+	slot.digest = msg.Digest
+	slot.request = msg.Request
+	slot.prePrepare = &prePrepare
+	slot.sentCommit = false
+
+	if !node.isPrimary() {
+		prepare := PBFTMessage{MsgType: PBFT_PREPARE, View: msg.View, Seq: msg.Seq, Digest: msg.Digest}
+		node.sign(&prepare)
+		node.broadcast(prepare)
+		slot.prepares[node.id] = prepare
+	}
+	node.checkPrepared(msg.Seq, slot)
+}
+
+func (node *PBFTNode) handlePrepare(msg *PBFTMessage) {
+	if msg.SenderId == node.primary(msg.View) || !node.inWindow(msg.Seq) {
+		return
+	}
+	slot := node.slot(msg.Seq)
+	slot.prepares[msg.SenderId] = *msg
+	node.checkPrepared(msg.Seq, slot)
+}
+
+func (node *PBFTNode) handleCommit(msg *PBFTMessage) {
+	if !node.inWindow(msg.Seq) {
+		return
+	}
+	slot := node.slot(msg.Seq)
+	slot.commits[msg.SenderId] = *msg
+	node.checkCommitted(msg.Seq, slot)
+}
+
+// matching returns the votes for the request the slot holds, by sender
+func matching(votes map[int]PBFTMessage, view int, digest PBFTDigest) []PBFTMessage {
+	matched := make([]PBFTMessage, 0)
+	for _, sender := range sortedKeys(votes) {
+		vote := votes[sender]
+		if vote.View == view && vote.Digest == digest {
+			matched = append(matched, vote)
+		}
+	}
+	return matched
+}
+
+func (node *PBFTNode) checkPrepared(seq int, slot *pbftSlot) {
+	if slot.prePrepare == nil || slot.view != node.view {
+		return
+	}
+	prepares := matching(slot.prepares, slot.view, slot.digest)
+	if len(prepares) < node.quorum-1 {
+		return
+	}
+	if slot.prepared == nil || slot.prepared.PrePrepare.View < slot.view {
+		slot.prepared = &PBFTPrepared{PrePrepare: *slot.prePrepare, Prepares: prepares[:node.quorum-1]}
+	}
+
+	if !slot.sentCommit {
+		slot.sentCommit = true
+		commit := PBFTMessage{MsgType: PBFT_COMMIT, View: slot.view, Seq: seq, Digest: slot.digest}
+		node.sign(&commit)
+		node.broadcast(commit)
+		slot.commits[node.id] = commit
+	}
+	node.checkCommitted(seq, slot)
+}
+
+func (node *PBFTNode) checkCommitted(seq int, slot *pbftSlot) {
+	if slot.committed || !slot.sentCommit {
+		return
+	}
+	if len(matching(slot.commits, slot.view, slot.digest)) < node.quorum {
+		return
+	}
+	slot.committed = true
+	if seq > node.highestSeen {
+		node.highestSeen = seq
+	}
+	node.executeReady()
+}
+
+/****************************************************************************************************/
+/***************************************Execution****************************************************/
+/****************************************************************************************************/
+
+// executeReady applies requests in sequence order, taking each either from
+//   a committed slot or from f+1 matching fetch replies
+func (node *PBFTNode) executeReady() {
+	for {
+		next := node.lastExecuted + 1
+		if slot, ok := node.slots[next]; ok && slot.committed {
+			node.execute(next, slot.request, slot.digest)
+			continue
+		}
+		digest, ok := node.fetchedDigest(next)
+		if !ok {
+			return
+		}
+		node.execute(next, node.fetchedRequests[digest], digest)
+	}
+}
+
+func (node *PBFTNode) execute(seq int, request *PBFTRequest, digest PBFTDigest) {
+	node.lastExecuted = seq
+	node.progressAt = node.clock.Now()
+	if request != nil {
+		origin := request.Origin
+		if request.ReqSeq > node.executedReqSeq[origin] {
+			node.executedReqSeq[origin] = request.ReqSeq
+			node.ml.UpdateModel(request.Grads)
+		}
+		if origin == node.id {
+			node.latency.committed(request.ReqSeq, node.clock.Now())
+			for reqSeq := range node.outstanding {
+				if reqSeq <= request.ReqSeq {
+					delete(node.outstanding, reqSeq)
+				}
+			}
+		}
+		node.removeWaiting(digest)
+	}
+
+	chain := sha256.New()
+	chain.Write(node.stateDigest[:])
+	pbftHasher{chain}.int(seq)
+	chain.Write(digest[:])
+	copy(node.stateDigest[:], chain.Sum(nil))
+
+	node.executedLog = append(node.executedLog, PBFTExecuted{Seq: seq, Request: request})
+	if len(node.executedLog) > node.retain {
+		node.executedLog = node.executedLog[len(node.executedLog)-node.retain:]
+	}
+	node.clearFetched()
+	if seq%node.checkpointInterval == 0 {
+		node.sendCheckpoint()
+	}
+}
+
+/****************************************************************************************************/
+/***************************************Timers*******************************************************/
+/****************************************************************************************************/
+
+func (node *PBFTNode) checkTimers() {
+	now := node.clock.Now()
+
+	// our own requests may have been lost, or ignored by the primary
+	resent := 0
+	for _, reqSeq := range sortedKeys(node.outstanding) {
+		outstanding := node.outstanding[reqSeq]
+		if resent < node.maxFetch && now.Sub(outstanding.sentAt) > node.requestTimeout/2 {
+			outstanding.sentAt = now
+			node.broadcast(outstanding.msg)
+			resent++
+		}
+	}
+
+	if node.viewChanging {
+		// like PBFT, only move on once a quorum wants this view too
+		if node.viewChangeVotes(node.view) >= node.quorum && now.Sub(node.viewChangeStarted) > node.viewChangeWait {
+			node.viewChangeWait *= 2
+			node.startViewChange(node.view + 1)
+		}
+		return
+	}
+	if node.lastExecuted < node.stableSeq {
+		// we are behind and fetching, the primary is not to blame
+		return
+	}
+	for _, waiting := range node.waiting {
+		next := waiting.request.ReqSeq == node.executedReqSeq[waiting.request.Origin]+1
+		if next && now.Sub(waiting.since) > node.requestTimeout {
+			fmt.Println("pbft node", node.id, "timed out on a request from", waiting.request.Origin, "in view", node.view)
+			node.startViewChange(node.view + 1)
+			return
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package protocols
+
+import (
+	"flads/util"
+	"fmt"
+)
+
+// A view change moves the primary to view % numNodes. Each node sends its
+//   stable checkpoint and every request it prepared after it, the new
+//   primary gathers a quorum of those and re-proposes the newest prepared
+//   request at each sequence number (or a null request where there is
+//   none). Everyone recomputes that from the view changes in NEW_VIEW, so
+//   a faulty primary cannot drop a request that may have committed.
+
+func (node *PBFTNode) startViewChange(view int) {
+	if view <= node.view {
+		return
+	}
+	if !node.viewChanging {
+		node.viewChangeWait = node.viewChangeTimeout
+	}
+	fmt.Println("pbft node", node.id, "starting view change to view", view)
+	node.view = view
+	node.viewChanging = true
+	node.viewChangeStarted = node.clock.Now()
+
+	prepared := make([]PBFTPrepared, 0)
+	for _, seq := range sortedKeys(node.slots) {
+		slot := node.slots[seq]
+		if seq > node.stableSeq && slot.prepared != nil {
+			prepared = append(prepared, *slot.prepared)
+		}
+	}
+	viewChange := PBFTMessage{
+		MsgType:    PBFT_VIEW_CHANGE,
+		View:       view,
+		Seq:        node.stableSeq,
+		Checkpoint: node.stableProof,
+		Prepared:   prepared,
+	}
+	node.sign(&viewChange)
+	node.broadcast(viewChange)
+	node.recordViewChange(&viewChange)
+}
+
+func (node *PBFTNode) handleViewChange(msg *PBFTMessage) {
+	if msg.View == node.view && !node.viewChanging {
+		// the sender missed our NEW_VIEW
+		if node.lastNewView != nil && node.lastNewView.View == node.view {
+			node.net.Send(msg.SenderId, *node.lastNewView)
+		}
+		return
+	}
+	if msg.View < node.view {
+		return
+	}
+	if !node.validViewChange(msg, msg.View) {
+		util.Logger.Println("dropping an invalid view change from", msg.SenderId)
+		return
+	}
+	node.recordViewChange(msg)
+}
+
+func (node *PBFTNode) recordViewChange(msg *PBFTMessage) {
+	if newest, ok := node.viewChanges[msg.SenderId]; ok && newest.View >= msg.View {
+		return
+	}
+	node.viewChanges[msg.SenderId] = *msg
+
+	// f+1 nodes want a newer view, so at least one honest one does
+	ahead := make([]int, 0)
+	for _, sender := range sortedKeys(node.viewChanges) {
+		if view := node.viewChanges[sender].View; view > node.view {
+			ahead = append(ahead, view)
+		}
+	}
+	if len(ahead) >= node.f+1 {
+		lowest := ahead[0]
+		for _, view := range ahead {
+			if view < lowest {
+				lowest = view
+			}
+		}
+		node.startViewChange(lowest)
+	}
+
+	if node.viewChanging && node.isPrimary() && node.viewChangeVotes(node.view) >= node.quorum {
+		node.sendNewView()
+	}
+}
+
+func (node *PBFTNode) viewChangeVotes(view int) int {
+	votes := 0
+	for _, viewChange := range node.viewChanges {
+		if viewChange.View == view {
+			votes++
+		}
+	}
+	return votes
+}
+
+func (node *PBFTNode) validViewChange(msg *PBFTMessage, view int) bool {
+	if msg.MsgType != PBFT_VIEW_CHANGE || msg.View != view || !node.verify(msg) {
+		return false
+	}
+	if !node.validCheckpointProof(msg.Seq, msg.Checkpoint) {
+		return false
+	}
+	for i := range msg.Prepared {
+		if !node.validPrepared(&msg.Prepared[i], msg) {
+			return false
+		}
+	}
+	return true
+}
+
+func (node *PBFTNode) validPrepared(prepared *PBFTPrepared, viewChange *PBFTMessage) bool {
+	prePrepare := &prepared.PrePrepare
+	if prePrepare.MsgType != PBFT_PRE_PREPARE || prePrepare.View >= viewChange.View {
+		return false
+	}
+	if prePrepare.Seq <= viewChange.Seq || prePrepare.Seq > viewChange.Seq+node.logWindow {
+		return false
+	}
+	if prePrepare.SenderId != node.primary(prePrepare.View) || !node.verify(prePrepare) {
+		return false
+	}
+	digest, ok := node.verifyRequest(prePrepare.Request)
+	if !ok || digest != prePrepare.Digest {
+		return false
+	}
+
+	senders := make(map[int]bool)
+	for i := range prepared.Prepares {
+		prepare := &prepared.Prepares[i]
+		if prepare.MsgType != PBFT_PREPARE || prepare.View != prePrepare.View ||
+			prepare.Seq != prePrepare.Seq || prepare.Digest != prePrepare.Digest {
+			return false
+		}
+		if prepare.SenderId == prePrepare.SenderId || !node.verify(prepare) {
+			return false
+		}
+		senders[prepare.SenderId] = true
+	}
+	return len(senders) >= node.quorum-1
+}
+
+// newViewPlan works out what the primary of view has to re-propose. It
+//   returns the newest stable checkpoint among the view changes, and the
+//   request to pre-prepare at each sequence number after it, nil where a
+//   null request goes.
+func (node *PBFTNode) newViewPlan(viewChanges []PBFTMessage) (int, []*PBFTMessage) {
+	minSeq, maxSeq := 0, 0
+	for _, viewChange := range viewChanges {
+		if viewChange.Seq > minSeq {
+			minSeq = viewChange.Seq
+		}
+	}
+	chosen := make(map[int]*PBFTMessage)
+	for i := range viewChanges {
+		for j := range viewChanges[i].Prepared {
+			prePrepare := &viewChanges[i].Prepared[j].PrePrepare
+			if prePrepare.Seq <= minSeq {
+				continue
+			}
+			if prePrepare.Seq > maxSeq {
+				maxSeq = prePrepare.Seq
+			}
+			if current, ok := chosen[prePrepare.Seq]; !ok || prePrepare.View > current.View {
+				chosen[prePrepare.Seq] = prePrepare
+			}
+		}
+	}
+
+	plan := make([]*PBFTMessage, 0)
+	for seq := minSeq + 1; seq <= maxSeq; seq++ {
+		plan = append(plan, chosen[seq])
+	}
+	return minSeq, plan
+}
+
+func (node *PBFTNode) viewChangesFor(view int) []PBFTMessage {
+	viewChanges := make([]PBFTMessage, 0)
+	for _, sender := range sortedKeys(node.viewChanges) {
+		if node.viewChanges[sender].View == view {
+			viewChanges = append(viewChanges, node.viewChanges[sender])
+		}
+	}
+	return viewChanges
+}
+
+func (node *PBFTNode) sendNewView() {
+	if node.lastNewView != nil && node.lastNewView.View == node.view {
+		return
+	}
+	viewChanges := node.viewChangesFor(node.view)
+	minSeq, plan := node.newViewPlan(viewChanges)
+
+	prePrepares := make([]PBFTMessage, 0, len(plan))
+	for i, prepared := range plan {
+		prePrepare := PBFTMessage{MsgType: PBFT_PRE_PREPARE, View: node.view, Seq: minSeq + 1 + i}
+		if prepared != nil {
+			prePrepare.Digest = prepared.Digest
+			prePrepare.Request = prepared.Request
+		}
+		node.sign(&prePrepare)
+		prePrepares = append(prePrepares, prePrepare)
+	}
+
+	newView := PBFTMessage{
+		MsgType:     PBFT_NEW_VIEW,
+		View:        node.view,
+		ViewChanges: viewChanges,
+		PrePrepares: prePrepares,
+	}
+	node.sign(&newView)
+	node.lastNewView = &newView
+	node.broadcast(newView)
+	node.installView(&newView, minSeq)
+}
+
+func (node *PBFTNode) handleNewView(msg *PBFTMessage) {
+	if msg.View < node.view || (msg.View == node.view && !node.viewChanging) {
+		return
+	}
+	if msg.SenderId != node.primary(msg.View) {
+		return
+	}
+
+	senders := make(map[int]bool)
+	for i := range msg.ViewChanges {
+		if !node.validViewChange(&msg.ViewChanges[i], msg.View) {
+			util.Logger.Println("dropping a new view with an invalid view change from", msg.SenderId)
+			return
+		}
+		senders[msg.ViewChanges[i].SenderId] = true
+	}
+	if len(senders) < node.quorum {
+		return
+	}
+
+	minSeq, plan := node.newViewPlan(msg.ViewChanges)
+	if len(plan) != len(msg.PrePrepares) {
+		util.Logger.Println("dropping a new view that does not match its view changes from", msg.SenderId)
+		return
+	}
+	for i, prepared := range plan {
+		prePrepare := &msg.PrePrepares[i]
+		expected := PBFTDigest{}
+		if prepared != nil {
+			expected = prepared.Digest
+		}
+		if prePrepare.MsgType != PBFT_PRE_PREPARE || prePrepare.View != msg.View || prePrepare.Seq != minSeq+1+i ||
+			prePrepare.Digest != expected || prePrepare.SenderId != msg.SenderId || !node.verify(prePrepare) {
+			util.Logger.Println("dropping a new view that does not match its view changes from", msg.SenderId)
+			return
+		}
+	}
+
+	node.installView(msg, minSeq)
+}
+
+func (node *PBFTNode) installView(newView *PBFTMessage, minSeq int) {
+	node.view = newView.View
+	node.viewChanging = false
+	node.viewChangeWait = node.viewChangeTimeout
+	fmt.Println("pbft node", node.id, "entered view", node.view, "with primary", node.primary(node.view))
+
+	// the newest checkpoint in the view changes is stable, and we may not
+	//   have it yet
+	for i := range newView.ViewChanges {
+		viewChange := &newView.ViewChanges[i]
+		if viewChange.Seq == minSeq && minSeq > node.stableSeq {
+			node.makeStable(minSeq, viewChange.Checkpoint)
+		}
+	}
+
+	for _, slot := range node.slots {
+		slot.prePrepare = nil
+		slot.sentCommit = false
+	}
+	for sender, viewChange := range node.viewChanges {
+		if viewChange.View <= node.view {
+			delete(node.viewChanges, sender)
+		}
+	}
+
+	// the new primary gets a full request timeout before we give up on it
+	now := node.clock.Now()
+	for i := range node.waiting {
+		node.waiting[i].since = now
+	}
+
+	node.assigned = make(map[PBFTDigest]bool)
+	node.assignedReqSeq = make(map[int]int)
+	node.seq = minSeq + len(newView.PrePrepares)
+	for i := range newView.PrePrepares {
+		prePrepare := &newView.PrePrepares[i]
+		if request := prePrepare.Request; request != nil {
+			node.assigned[prePrepare.Digest] = true
+			if request.ReqSeq > node.assignedReqSeq[request.Origin] {
+				node.assignedReqSeq[request.Origin] = request.ReqSeq
+			}
+		}
+		node.acceptPrePrepare(prePrepare)
+	}
+
+	future := node.future
+	node.future = nil
+	for i := range future {
+		if future[i].View == node.view {
+			node.handleNormal(&future[i])
+		} else if future[i].View > node.view {
+			node.future = append(node.future, future[i])
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package protocols
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A QuorumVerifier decides which sets of voters make a quorum. Any two
+//   quorums have to intersect. ZabConfig picks the verifier from its
+//   members: a plain majority, or ZooKeeper's hierarchical quorums once
+//   the members are put into groups.
+type QuorumVerifier interface {
+	// ContainsQuorum reports whether nodeIds include a quorum, duplicates
+	//   and ids that do not vote are ignored
+	ContainsQuorum(nodeIds []int) bool
+}
+
+type MajorityVerifier struct {
+	voters map[int]bool
+}
+
+func MakeMajorityVerifier(voters []int) *MajorityVerifier {
+	verifier := &MajorityVerifier{voters: make(map[int]bool)}
+	for _, id := range voters {
+		verifier.voters[id] = true
+	}
+	return verifier
+}
+
+func (verifier *MajorityVerifier) ContainsQuorum(nodeIds []int) bool {
+	seen := make(map[int]bool)
+	for _, id := range nodeIds {
+		if verifier.voters[id] {
+			seen[id] = true
+		}
+	}
+	return len(seen) > len(verifier.voters)/2
+}
+
+// HierarchicalVerifier is ZooKeeper's QuorumHierarchical. Voters are in
+//   groups and have weights, and a quorum holds more than half the weight
+//   of more than half of the groups. Groups whose weight is 0 are left out
+//   of the count, and a node of weight 0 takes part in everything without
+//   counting towards quorums.
+type HierarchicalVerifier struct {
+	groups       map[int]int
+	weights      map[int]int
+	groupWeights map[int]int
+}
+
+func MakeHierarchicalVerifier(groups map[int][]int, weights map[int]int) *HierarchicalVerifier {
+	verifier := &HierarchicalVerifier{
+		groups:       make(map[int]int),
+		weights:      make(map[int]int),
+		groupWeights: make(map[int]int),
+	}
+	for group, ids := range groups {
+		for _, id := range ids {
+			verifier.groups[id] = group
+			verifier.weights[id] = weights[id]
+			verifier.groupWeights[group] += weights[id]
+		}
+	}
+	return verifier
+}
+
+func (verifier *HierarchicalVerifier) ContainsQuorum(nodeIds []int) bool {
+	seen := make(map[int]bool)
+	weights := make(map[int]int)
+	for _, id := range nodeIds {
+		group, ok := verifier.groups[id]
+		if !ok || seen[id] {
+			continue
+		}
+		seen[id] = true
+		weights[group] += verifier.weights[id]
+	}
+	groups, majorities := 0, 0
+	for _, group := range sortedKeys(verifier.groupWeights) {
+		total := verifier.groupWeights[group]
+		if total == 0 {
+			continue
+		}
+		groups++
+		if 2*weights[group] > total {
+			majorities++
+		}
+	}
+	return 2*majorities > groups
+}
+
+// SetQuorumGroups switches to hierarchical quorums. groups lists the
+//   voters of each group, and every voter has to be in exactly one. Nodes
+//   missing from weights have weight 1. Must be called with the same
+//   groups and weights on every node, after SetObservers and before Run.
+func (node *ZabNode) SetQuorumGroups(groups [][]int, weights map[int]int) error {
+	members := make(map[int]ZabMember)
+	for id, member := range node.config.Members {
+		member.Group = 0
+		member.Weight = 0
+		members[id] = member
+	}
+	for i, ids := range groups {
+		for _, id := range ids {
+			member, ok := members[id]
+			if !ok || member.Observer {
+				return fmt.Errorf("node %d in quorum group %d is not a voter", id, i+1)
+			}
+			if member.Group != 0 {
+				return fmt.Errorf("node %d is in quorum groups %d and %d", id, member.Group, i+1)
+			}
+			member.Group = i + 1
+			member.Weight = 1
+			if weight, ok := weights[id]; ok {
+				member.Weight = weight
+			}
+			members[id] = member
+		}
+	}
+	config := ZabConfig{node.config.Version, members}
+	if err := config.validate(); err != nil {
+		return err
+	}
+	node.config = config
+	return nil
+}
+
+func (config ZabConfig) hierarchical() bool {
+	for _, member := range config.Members {
+		if !member.Observer && member.Group != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (config ZabConfig) verifier() QuorumVerifier {
+	if !config.hierarchical() {
+		return MakeMajorityVerifier(config.voters())
+	}
+	groups := make(map[int][]int)
+	weights := make(map[int]int)
+	for _, id := range config.voters() {
+		member := config.Members[id]
+		groups[member.Group] = append(groups[member.Group], id)
+		weights[id] = member.Weight
+	}
+	return MakeHierarchicalVerifier(groups, weights)
+}
+
+// validate checks that the voters of config can form a quorum at all
+func (config ZabConfig) validate() error {
+	voters := config.voters()
+	if len(voters) == 0 {
+		return errors.New("config has no voters")
+	}
+	if config.hierarchical() {
+		for _, id := range voters {
+			member := config.Members[id]
+			if member.Group == 0 {
+				return fmt.Errorf("voter %d is in no quorum group", id)
+			}
+			if member.Weight < 0 {
+				return fmt.Errorf("voter %d has a negative weight", id)
+			}
+		}
+	}
+	if !config.verifier().ContainsQuorum(voters) {
+		return errors.New("the voters of the config do not make a quorum")
+	}
+	return nil
+}
@@ -0,0 +1,493 @@
+package protocols
+
+import (
+	"flads/ds/network"
+	"flads/ml"
+	"flads/util"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// RaftNode orders gradient updates with Raft, as an alternative to Zab.
+//   Every node hands its gradients to the leader (or appends them itself
+//   if it leads), the leader replicates its log with AppendEntries, and
+//   entries are applied with UpdateModel once committed. Heartbeats are
+//   empty AppendEntries, so heartbeatNet is not used. Nothing is persisted:
+//   a node that restarts rejoins with an empty log.
+
+type RaftMsgType string
+
+const (
+	REQUEST_VOTE   = "REQUEST_VOTE"
+	VOTE_REPLY     = "VOTE_REPLY"
+	APPEND_ENTRIES = "APPEND_ENTRIES"
+	APPEND_REPLY   = "APPEND_REPLY"
+	FORWARD_WRITE  = "FORWARD_WRITE"
+)
+
+type RaftMessage struct {
+	SenderId int
+	MsgType  RaftMsgType
+	Term     int
+
+	// REQUEST_VOTE, VOTE_REPLY
+	LastLogIndex int
+	LastLogTerm  int
+	VoteGranted  bool
+
+	// APPEND_ENTRIES, APPEND_REPLY
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []RaftEntry
+	LeaderCommit int
+	Success      bool
+	MatchIndex   int
+
+	// FORWARD_WRITE
+	Entry RaftEntry
+}
+
+// Origin and Seq identify the write for latency measurements. An entry
+//   with Origin -1 is the no-op a new leader appends to commit the entries
+//   of earlier terms.
+type RaftEntry struct {
+	Term   int
+	Origin int
+	Seq    int
+	Grads  ml.Gradients
+}
+
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+type RaftNode struct {
+	id       int
+	numNodes int
+	name     string
+	ml       ml.MLProcess
+	net      network.Network[RaftMessage]
+	clock    util.Clock
+	rng      *rand.Rand
+
+	role        raftRole
+	currentTerm int
+	votedFor    int
+	leaderId    int
+	log         []RaftEntry
+	commitIndex int
+	lastApplied int
+
+	// candidate
+	votes map[int]bool
+
+	// leader
+	nextIndex  map[int]int
+	matchIndex map[int]int
+	lastSent   int
+
+	electionDeadline   time.Time
+	electionTimeoutMin time.Duration
+	electionTimeoutMax time.Duration
+	lastHeartbeat      time.Time
+	heartbeatPeriod    time.Duration
+	receiveTimeout     time.Duration
+	maxEntries         int
+
+	// our writes, pending ones are waiting for a leader to be known
+	nextSeq int
+	pending []RaftEntry
+	latency commitLatency
+}
+
+func (node *RaftNode) Initialize(id int, name string, mlp ml.MLProcess, net network.Network[RaftMessage], heartbeatNet network.Network[RaftMessage], numNodes int, leaderId int) {
+	node.id = id
+	node.numNodes = numNodes
+	node.name = name
+	node.ml = mlp
+	node.net = net
+	node.clock = util.SystemClock
+	node.rng = rand.New(rand.NewSource(int64(id) + 1))
+
+	node.role = raftFollower
+	node.currentTerm = 0
+	node.votedFor = -1
+	node.leaderId = -1
+	// index 0 is a sentinel so the first real entry has index 1
+	node.log = []RaftEntry{{Term: 0, Origin: -1}}
+	node.commitIndex = 0
+	node.lastApplied = 0
+
+	node.electionTimeoutMin = 300 * time.Millisecond
+	node.electionTimeoutMax = 600 * time.Millisecond
+	node.heartbeatPeriod = 100 * time.Millisecond
+	node.receiveTimeout = 50 * time.Millisecond
+	node.maxEntries = 64
+	node.resetElectionTimer()
+}
+
+func (node *RaftNode) SetClock(clock util.Clock) {
+	node.clock = clock
+	node.resetElectionTimer()
+}
+
+func (node *RaftNode) CommitLatency() (time.Duration, int) {
+	return node.latency.mean()
+}
+
+func (node *RaftNode) Run() {
+	now := node.clock.Now()
+	if node.role != raftLeader && now.After(node.electionDeadline) {
+		node.startElection()
+	}
+
+	if ready, localGrads := node.ml.GetGradients(); ready {
+		node.write(localGrads)
+	}
+
+	msg, received := node.net.ReceiveTimeout(node.receiveTimeout)
+	for received {
+		switch msg.MsgType {
+		case REQUEST_VOTE:
+			node.handleRequestVote(&msg)
+		case VOTE_REPLY:
+			node.handleVoteReply(&msg)
+		case APPEND_ENTRIES:
+			node.handleAppendEntries(&msg)
+		case APPEND_REPLY:
+			node.handleAppendReply(&msg)
+		case FORWARD_WRITE:
+			node.handleForwardWrite(&msg)
+		}
+		msg, received = node.net.ReceiveTimeout(0)
+	}
+
+	if node.role == raftLeader {
+		heartbeatDue := node.clock.Now().Sub(node.lastHeartbeat) >= node.heartbeatPeriod
+		if heartbeatDue || node.lastSent < len(node.log)-1 {
+			node.replicate()
+		}
+	}
+	node.apply()
+}
+
+/****************************************************************************************************/
+/***************************************Election*****************************************************/
+/****************************************************************************************************/
+
+func (node *RaftNode) resetElectionTimer() {
+	spread := int64(node.electionTimeoutMax - node.electionTimeoutMin)
+	timeout := node.electionTimeoutMin + time.Duration(node.rng.Int63n(spread+1))
+	node.electionDeadline = node.clock.Now().Add(timeout)
+}
+
+func (node *RaftNode) startElection() {
+	node.role = raftCandidate
+	node.currentTerm++
+	node.votedFor = node.id
+	node.leaderId = -1
+	node.votes = map[int]bool{node.id: true}
+	node.resetElectionTimer()
+	fmt.Println("raft node", node.id, "starting election for term", node.currentTerm)
+
+	if len(node.votes) > node.numNodes/2 {
+		node.becomeLeader()
+		return
+	}
+	err := node.net.BroadcastToRest(RaftMessage{
+		SenderId:     node.id,
+		MsgType:      REQUEST_VOTE,
+		Term:         node.currentTerm,
+		LastLogIndex: len(node.log) - 1,
+		LastLogTerm:  node.log[len(node.log)-1].Term,
+	})
+	if err != nil {
+		util.Logger.Println("error requesting votes:", err)
+	}
+}
+
+func (node *RaftNode) handleRequestVote(msg *RaftMessage) {
+	if msg.Term > node.currentTerm {
+		node.becomeFollower(msg.Term, -1)
+	}
+
+	lastTerm := node.log[len(node.log)-1].Term
+	upToDate := msg.LastLogTerm > lastTerm ||
+		(msg.LastLogTerm == lastTerm && msg.LastLogIndex >= len(node.log)-1)
+	granted := msg.Term == node.currentTerm && upToDate &&
+		(node.votedFor == -1 || node.votedFor == msg.SenderId)
+	if granted {
+		node.votedFor = msg.SenderId
+		node.resetElectionTimer()
+	}
+
+	node.net.Send(msg.SenderId, RaftMessage{
+		SenderId:    node.id,
+		MsgType:     VOTE_REPLY,
+		Term:        node.currentTerm,
+		VoteGranted: granted,
+	})
+}
+
+func (node *RaftNode) handleVoteReply(msg *RaftMessage) {
+	if msg.Term > node.currentTerm {
+		node.becomeFollower(msg.Term, -1)
+		return
+	}
+	if node.role != raftCandidate || msg.Term != node.currentTerm || !msg.VoteGranted {
+		return
+	}
+	node.votes[msg.SenderId] = true
+	if len(node.votes) > node.numNodes/2 {
+		node.becomeLeader()
+	}
+}
+
+func (node *RaftNode) becomeFollower(term int, leaderId int) {
+	if term > node.currentTerm {
+		node.currentTerm = term
+		node.votedFor = -1
+	}
+	if node.role != raftFollower {
+		fmt.Println("raft node", node.id, "following in term", node.currentTerm)
+	}
+	node.role = raftFollower
+	node.leaderId = leaderId
+}
+
+func (node *RaftNode) becomeLeader() {
+	fmt.Println("raft node", node.id, "is leader for term", node.currentTerm)
+	node.role = raftLeader
+	node.leaderId = node.id
+	node.nextIndex = make(map[int]int)
+	node.matchIndex = make(map[int]int)
+	for id := 0; id < node.numNodes; id++ {
+		node.nextIndex[id] = len(node.log)
+		node.matchIndex[id] = 0
+	}
+
+	// entries from earlier terms only commit once one from ours does
+	node.appendEntry(RaftEntry{Origin: -1})
+	node.flushPending()
+	node.replicate()
+}
+
+/****************************************************************************************************/
+/***************************************Replication**************************************************/
+/****************************************************************************************************/
+
+func (node *RaftNode) write(grads ml.Gradients) {
+	node.nextSeq++
+	node.latency.sent(node.nextSeq, node.clock.Now())
+	entry := RaftEntry{Origin: node.id, Seq: node.nextSeq, Grads: grads}
+
+	if node.role == raftLeader {
+		node.appendEntry(entry)
+	} else if node.leaderId != -1 {
+		node.forward(entry)
+	} else {
+		node.pending = append(node.pending, entry)
+	}
+}
+
+func (node *RaftNode) forward(entry RaftEntry) {
+	err := node.net.Send(node.leaderId, RaftMessage{
+		SenderId: node.id,
+		MsgType:  FORWARD_WRITE,
+		Term:     node.currentTerm,
+		Entry:    entry,
+	})
+	if err != nil {
+		util.Logger.Println("failed to forward write to", node.leaderId, err)
+	}
+}
+
+func (node *RaftNode) flushPending() {
+	pending := node.pending
+	node.pending = nil
+	for _, entry := range pending {
+		if node.role == raftLeader {
+			node.appendEntry(entry)
+		} else {
+			node.forward(entry)
+		}
+	}
+}
+
+func (node *RaftNode) handleForwardWrite(msg *RaftMessage) {
+	if node.role == raftLeader {
+		node.appendEntry(msg.Entry)
+	} else if node.leaderId != -1 && node.leaderId != msg.SenderId {
+		node.forward(msg.Entry)
+	} else {
+		node.pending = append(node.pending, msg.Entry)
+	}
+}
+
+func (node *RaftNode) appendEntry(entry RaftEntry) {
+	entry.Term = node.currentTerm
+	node.log = append(node.log, entry)
+	node.matchIndex[node.id] = len(node.log) - 1
+	node.advanceCommit()
+}
+
+// replicate sends every follower the entries it does not have yet, or an
+//   empty heartbeat. nextIndex is advanced optimistically, a follower that
+//   misses a message rejects the next one and we back off.
+func (node *RaftNode) replicate() {
+	node.lastHeartbeat = node.clock.Now()
+	node.lastSent = len(node.log) - 1
+	for id := 0; id < node.numNodes; id++ {
+		if id == node.id {
+			continue
+		}
+		next := node.nextIndex[id]
+		end := len(node.log)
+		if end-next > node.maxEntries {
+			end = next + node.maxEntries
+		}
+		entries := append([]RaftEntry{}, node.log[next:end]...)
+		err := node.net.Send(id, RaftMessage{
+			SenderId:     node.id,
+			MsgType:      APPEND_ENTRIES,
+			Term:         node.currentTerm,
+			PrevLogIndex: next - 1,
+			PrevLogTerm:  node.log[next-1].Term,
+			Entries:      entries,
+			LeaderCommit: node.commitIndex,
+		})
+		if err != nil {
+			util.Logger.Println("failed to send entries to", id, err)
+			continue
+		}
+		node.nextIndex[id] = end
+	}
+}
+
+func (node *RaftNode) handleAppendEntries(msg *RaftMessage) {
+	if msg.Term < node.currentTerm {
+		node.net.Send(msg.SenderId, RaftMessage{
+			SenderId: node.id,
+			MsgType:  APPEND_REPLY,
+			Term:     node.currentTerm,
+			Success:  false,
+		})
+		return
+	}
+	if msg.Term > node.currentTerm || node.role != raftFollower {
+		node.becomeFollower(msg.Term, msg.SenderId)
+	}
+	node.leaderId = msg.SenderId
+	node.resetElectionTimer()
+	node.flushPending()
+
+	if msg.PrevLogIndex >= len(node.log) || node.log[msg.PrevLogIndex].Term != msg.PrevLogTerm {
+		// tell the leader where to back off to
+		hint := len(node.log) - 1
+		if msg.PrevLogIndex < len(node.log) {
+			hint = msg.PrevLogIndex - 1
+		}
+		node.net.Send(msg.SenderId, RaftMessage{
+			SenderId:   node.id,
+			MsgType:    APPEND_REPLY,
+			Term:       node.currentTerm,
+			Success:    false,
+			MatchIndex: hint,
+		})
+		return
+	}
+
+	for i, entry := range msg.Entries {
+		index := msg.PrevLogIndex + 1 + i
+		if index < len(node.log) {
+			if node.log[index].Term == entry.Term {
+				continue
+			}
+			// conflicting entries are never committed, drop them
+			node.log = node.log[:index]
+		}
+		node.log = append(node.log, entry)
+	}
+
+	match := msg.PrevLogIndex + len(msg.Entries)
+	if msg.LeaderCommit > node.commitIndex {
+		node.commitIndex = msg.LeaderCommit
+		if match < node.commitIndex {
+			node.commitIndex = match
+		}
+	}
+	node.net.Send(msg.SenderId, RaftMessage{
+		SenderId:   node.id,
+		MsgType:    APPEND_REPLY,
+		Term:       node.currentTerm,
+		Success:    true,
+		MatchIndex: match,
+	})
+}
+
+func (node *RaftNode) handleAppendReply(msg *RaftMessage) {
+	if msg.Term > node.currentTerm {
+		node.becomeFollower(msg.Term, -1)
+		return
+	}
+	if node.role != raftLeader || msg.Term != node.currentTerm {
+		return
+	}
+
+	if msg.Success {
+		if msg.MatchIndex > node.matchIndex[msg.SenderId] {
+			node.matchIndex[msg.SenderId] = msg.MatchIndex
+		}
+		if node.nextIndex[msg.SenderId] <= node.matchIndex[msg.SenderId] {
+			node.nextIndex[msg.SenderId] = node.matchIndex[msg.SenderId] + 1
+		}
+		node.advanceCommit()
+	} else {
+		next := msg.MatchIndex + 1
+		if next < 1 {
+			next = 1
+		}
+		if next < node.nextIndex[msg.SenderId] {
+			node.nextIndex[msg.SenderId] = next
+		}
+	}
+}
+
+// advanceCommit commits the newest entry of our term that a majority has
+//   stored, and with it everything before it
+func (node *RaftNode) advanceCommit() {
+	for index := len(node.log) - 1; index > node.commitIndex; index-- {
+		if node.log[index].Term != node.currentTerm {
+			break
+		}
+		count := 0
+		for id := 0; id < node.numNodes; id++ {
+			if node.matchIndex[id] >= index {
+				count++
+			}
+		}
+		if count > node.numNodes/2 {
+			node.commitIndex = index
+			break
+		}
+	}
+}
+
+func (node *RaftNode) apply() {
+	for node.lastApplied < node.commitIndex {
+		node.lastApplied++
+		entry := node.log[node.lastApplied]
+		if entry.Origin == -1 {
+			continue
+		}
+		node.ml.UpdateModel(entry.Grads)
+		if entry.Origin == node.id {
+			node.latency.committed(entry.Seq, node.clock.Now())
+		}
+	}
+}
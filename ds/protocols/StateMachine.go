@@ -0,0 +1,14 @@
+package protocols
+
+// StateMachine is the state a protocol replicates. Commands are opaque to
+//   the protocol, it only agrees on their order and hands each committed
+//   command to Apply on every node in that order. Snapshot and Restore let
+//   it compact its log and bring a lagging node up to date without
+//   replaying every command.
+type StateMachine interface {
+	// Apply must be deterministic, every node applies the same commands
+	//   and has to end up in the same state
+	Apply(command []byte) error
+	Snapshot() ([]byte, error)
+	Restore(snapshot []byte) error
+}
@@ -0,0 +1,85 @@
+package protocols
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+)
+
+// StateMachineMux lets several state machines share one log. Commands are
+//   tagged with the name of the machine they are for, and a snapshot holds
+//   a snapshot of every machine.
+type StateMachineMux struct {
+	machines map[string]StateMachine
+}
+
+type muxCommand struct {
+	Name    string
+	Command []byte
+}
+
+func MakeStateMachineMux() *StateMachineMux {
+	return &StateMachineMux{make(map[string]StateMachine)}
+}
+
+// Add must be called with the same machines on every node
+func (mux *StateMachineMux) Add(name string, sm StateMachine) {
+	mux.machines[name] = sm
+}
+
+// Command tags command for the machine called name
+func (mux *StateMachineMux) Command(name string, command []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(muxCommand{name, command})
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (mux *StateMachineMux) Apply(command []byte) error {
+	var tagged muxCommand
+	err := gob.NewDecoder(bytes.NewReader(command)).Decode(&tagged)
+	if err != nil {
+		return err
+	}
+	sm, ok := mux.machines[tagged.Name]
+	if !ok {
+		return fmt.Errorf("no state machine called %q", tagged.Name)
+	}
+	return sm.Apply(tagged.Command)
+}
+
+func (mux *StateMachineMux) Snapshot() ([]byte, error) {
+	snapshots := make(map[string][]byte)
+	for name, sm := range mux.machines {
+		snapshot, err := sm.Snapshot()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		snapshots[name] = snapshot
+	}
+
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(snapshots)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (mux *StateMachineMux) Restore(snapshot []byte) error {
+	var snapshots map[string][]byte
+	err := gob.NewDecoder(bytes.NewReader(snapshot)).Decode(&snapshots)
+	if err != nil {
+		return err
+	}
+	for name, sm := range mux.machines {
+		if snapshot, ok := snapshots[name]; ok {
+			if err := sm.Restore(snapshot); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
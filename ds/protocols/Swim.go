@@ -0,0 +1,541 @@
+package protocols
+
+import (
+	"flads/ds/network"
+	"flads/util"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Swim is a membership service after SWIM (Das et al.) with the
+//   refinements memberlist made common. Every probePeriod a node pings one
+//   member, going round robin through a shuffled list. If no ack comes
+//   back within probeTimeout it asks indirectProbes other members to ping
+//   it with PINGREQ, and if none of them gets an ack by the end of the
+//   period the member is suspected. A suspected member that does not
+//   refute within suspicionTimeout is declared dead. A member refutes by
+//   gossiping that it is alive with a higher incarnation number, and only
+//   gossip about a newer incarnation overrides what a node knows.
+//
+//   There are no broadcasts: updates to the membership are piggybacked on
+//   pings and acks, each one a few times per member, so every node learns
+//   about a change in O(log n) periods. A node joins by pinging seeds it
+//   knows the addresses of, a seed answers a stranger with everything it
+//   knows.
+
+type SwimMsgType string
+
+const (
+	SWIM_PING    = "SWIM_PING"
+	SWIM_PINGREQ = "SWIM_PINGREQ"
+	SWIM_ACK     = "SWIM_ACK"
+)
+
+type SwimState string
+
+const (
+	SWIM_ALIVE   = "SWIM_ALIVE"
+	SWIM_SUSPECT = "SWIM_SUSPECT"
+	SWIM_DEAD    = "SWIM_DEAD"
+	SWIM_LEFT    = "SWIM_LEFT"
+)
+
+type SwimEventKind string
+
+const (
+	SWIM_JOIN  = "SWIM_JOIN"
+	SWIM_LEAVE = "SWIM_LEAVE"
+	SWIM_FAIL  = "SWIM_FAIL"
+)
+
+type SwimMessage struct {
+	SenderId int
+	MsgType  SwimMsgType
+	Seq      int
+	// PINGREQ: the member to ping for the sender, ACK: the member that
+	//   answered
+	TargetId int
+	Updates  []SwimUpdate
+}
+
+type SwimUpdate struct {
+	NodeId      int
+	Address     string
+	State       SwimState
+	Incarnation int
+}
+
+type SwimMember struct {
+	Id          int
+	Address     string
+	State       SwimState
+	Incarnation int
+}
+
+type SwimEvent struct {
+	Kind   SwimEventKind
+	Member SwimMember
+}
+
+type swimMember struct {
+	SwimMember
+	suspectedAt time.Time
+}
+
+type swimGossip struct {
+	update SwimUpdate
+	sent   int
+}
+
+// swimProbe is the ping of the current period
+type swimProbe struct {
+	target       int
+	seq          int
+	sentAt       time.Time
+	acked        bool
+	indirectSent bool
+}
+
+// swimForward is a ping we send for a PINGREQ, the ack goes to requester
+type swimForward struct {
+	requester int
+	seq       int
+	target    int
+	sentAt    time.Time
+}
+
+type Swim struct {
+	lock sync.Mutex
+
+	id          int
+	address     string
+	incarnation int
+	net         network.Network[SwimMessage]
+	clock       util.Clock
+	rand        *rand.Rand
+
+	members    map[int]*swimMember
+	gossip     map[int]*swimGossip
+	probeOrder []int
+	probe      *swimProbe
+	nextProbe  time.Time
+	forwards   map[int]swimForward
+	nextSeq    int
+	seeds      []int
+
+	subscribers  map[int]func(SwimEvent)
+	nextSubId    int
+	events       []SwimEvent
+	running      bool
+	leftAt       time.Time
+	leaving      bool
+	pollInterval time.Duration
+
+	probePeriod      time.Duration
+	probeTimeout     time.Duration
+	suspicionTimeout time.Duration
+	indirectProbes   int
+	maxPiggyback     int
+	retransmitMult   int
+}
+
+// MakeSwim makes the membership service of node id, which is reachable at
+//   address over net. The seed makes the probe order reproducible.
+func MakeSwim(id int, address string, net network.Network[SwimMessage], seed int64) *Swim {
+	return &Swim{
+		id:               id,
+		address:          address,
+		net:              net,
+		clock:            util.SystemClock,
+		rand:             rand.New(rand.NewSource(seed)),
+		members:          make(map[int]*swimMember),
+		gossip:           make(map[int]*swimGossip),
+		forwards:         make(map[int]swimForward),
+		subscribers:      make(map[int]func(SwimEvent)),
+		pollInterval:     10 * time.Millisecond,
+		probePeriod:      time.Second,
+		probeTimeout:     300 * time.Millisecond,
+		suspicionTimeout: 5 * time.Second,
+		indirectProbes:   3,
+		maxPiggyback:     8,
+		retransmitMult:   4,
+	}
+}
+
+func (swim *Swim) SetClock(clock util.Clock) {
+	swim.clock = clock
+}
+
+// SetTiming configures probing. probeTimeout has to be well below
+//   probePeriod to leave time for the indirect probes.
+func (swim *Swim) SetTiming(probePeriod time.Duration, probeTimeout time.Duration, suspicionTimeout time.Duration, indirectProbes int) {
+	swim.probePeriod = probePeriod
+	swim.probeTimeout = probeTimeout
+	swim.suspicionTimeout = suspicionTimeout
+	swim.indirectProbes = indirectProbes
+}
+
+// Subscribe calls callback for every member that joins, leaves or fails,
+//   outside of the lock so it may call back into swim
+func (swim *Swim) Subscribe(callback func(SwimEvent)) int {
+	swim.lock.Lock()
+	defer swim.lock.Unlock()
+	swim.nextSubId++
+	swim.subscribers[swim.nextSubId] = callback
+	return swim.nextSubId
+}
+
+func (swim *Swim) Unsubscribe(id int) {
+	swim.lock.Lock()
+	defer swim.lock.Unlock()
+	delete(swim.subscribers, id)
+}
+
+// Start joins through seeds, ids that are in the network's node id table
+//   already. A node without seeds starts a group of its own.
+func (swim *Swim) Start(seeds []int) {
+	swim.lock.Lock()
+	swim.seeds = seeds
+	swim.running = true
+	swim.enqueue(swim.selfUpdate(SWIM_ALIVE))
+	swim.nextProbe = swim.clock.Now()
+	swim.lock.Unlock()
+	swim.clock.AfterFunc(0, swim.tick)
+}
+
+// Leave tells the group this node is leaving. It keeps answering pings for
+//   two probe periods so the news gets around, then stops.
+func (swim *Swim) Leave() {
+	swim.lock.Lock()
+	defer swim.lock.Unlock()
+	if swim.leaving {
+		return
+	}
+	swim.leaving = true
+	swim.leftAt = swim.clock.Now()
+	swim.incarnation++
+	swim.enqueue(swim.selfUpdate(SWIM_LEFT))
+	for _, id := range swim.liveMembers() {
+		swim.send(id, SwimMessage{SenderId: swim.id, MsgType: SWIM_PING, Seq: swim.newSeq(), TargetId: id})
+	}
+}
+
+// Members returns the members that are alive or suspected, this node
+//   included unless it is leaving
+func (swim *Swim) Members() []SwimMember {
+	swim.lock.Lock()
+	defer swim.lock.Unlock()
+	members := []SwimMember{}
+	if !swim.leaving {
+		members = append(members, SwimMember{swim.id, swim.address, SWIM_ALIVE, swim.incarnation})
+	}
+	for _, id := range swim.liveMembers() {
+		members = append(members, swim.members[id].SwimMember)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Id < members[j].Id })
+	return members
+}
+
+func (swim *Swim) tick() {
+	swim.lock.Lock()
+	if !swim.running {
+		swim.lock.Unlock()
+		return
+	}
+	msg, received := swim.net.Receive()
+	for received {
+		swim.handleMessage(&msg)
+		msg, received = swim.net.Receive()
+	}
+	now := swim.clock.Now()
+	if swim.leaving {
+		if now.Sub(swim.leftAt) >= 2*swim.probePeriod {
+			fmt.Println("swim node", swim.id, "left the group")
+			swim.running = false
+		}
+	} else {
+		swim.probeTick(now)
+		swim.suspicionTick(now)
+	}
+	for seq, forward := range swim.forwards {
+		if now.Sub(forward.sentAt) >= swim.probePeriod {
+			delete(swim.forwards, seq)
+		}
+	}
+	events := swim.events
+	swim.events = nil
+	subscribers := make([]func(SwimEvent), 0, len(swim.subscribers))
+	for _, id := range sortedKeys(swim.subscribers) {
+		subscribers = append(subscribers, swim.subscribers[id])
+	}
+	running := swim.running
+	swim.lock.Unlock()
+
+	for _, event := range events {
+		for _, callback := range subscribers {
+			callback(event)
+		}
+	}
+	if running {
+		swim.clock.AfterFunc(swim.pollInterval, swim.tick)
+	}
+}
+
+// probeTick sends the indirect probes when the ping timed out, and at the
+//   end of a period suspects an unanswered target and starts the next probe
+func (swim *Swim) probeTick(now time.Time) {
+	probe := swim.probe
+	if probe != nil && !probe.acked && !probe.indirectSent && now.Sub(probe.sentAt) >= swim.probeTimeout {
+		probe.indirectSent = true
+		helpers := swim.randomMembers(swim.indirectProbes, probe.target)
+		util.Logger.Println("swim", swim.id, "asking", helpers, "to probe", probe.target)
+		for _, helper := range helpers {
+			swim.send(helper, SwimMessage{SenderId: swim.id, MsgType: SWIM_PINGREQ, Seq: probe.seq, TargetId: probe.target})
+		}
+	}
+	if now.Before(swim.nextProbe) {
+		return
+	}
+	swim.nextProbe = now.Add(swim.probePeriod)
+	if probe != nil && !probe.acked {
+		if member, ok := swim.members[probe.target]; ok && member.State == SWIM_ALIVE {
+			swim.suspect(member, member.Incarnation)
+		}
+	}
+	swim.probe = nil
+
+	target, ok := swim.nextTarget()
+	if !ok {
+		// nobody to probe yet, keep knocking on the seeds
+		for _, seed := range swim.seeds {
+			if seed != swim.id {
+				swim.send(seed, SwimMessage{SenderId: swim.id, MsgType: SWIM_PING, Seq: swim.newSeq(), TargetId: seed})
+			}
+		}
+		return
+	}
+	swim.probe = &swimProbe{target: target, seq: swim.newSeq(), sentAt: now}
+	swim.send(target, SwimMessage{SenderId: swim.id, MsgType: SWIM_PING, Seq: swim.probe.seq, TargetId: target})
+}
+
+func (swim *Swim) suspicionTick(now time.Time) {
+	for _, id := range sortedKeys(swim.members) {
+		member := swim.members[id]
+		if member.State == SWIM_SUSPECT && now.Sub(member.suspectedAt) >= swim.suspicionTimeout {
+			fmt.Println("swim", swim.id, "declares", id, "dead")
+			swim.setState(member, SWIM_DEAD, member.Incarnation)
+		}
+	}
+}
+
+// nextTarget goes round robin through the live members, reshuffling
+//   after every round
+func (swim *Swim) nextTarget() (int, bool) {
+	for {
+		if len(swim.probeOrder) == 0 {
+			swim.probeOrder = swim.liveMembers()
+			if len(swim.probeOrder) == 0 {
+				return 0, false
+			}
+			swim.rand.Shuffle(len(swim.probeOrder), func(i, j int) {
+				swim.probeOrder[i], swim.probeOrder[j] = swim.probeOrder[j], swim.probeOrder[i]
+			})
+		}
+		target := swim.probeOrder[0]
+		swim.probeOrder = swim.probeOrder[1:]
+		if member, ok := swim.members[target]; ok && (member.State == SWIM_ALIVE || member.State == SWIM_SUSPECT) {
+			return target, true
+		}
+	}
+}
+
+func (swim *Swim) liveMembers() []int {
+	ids := []int{}
+	for _, id := range sortedKeys(swim.members) {
+		state := swim.members[id].State
+		if state == SWIM_ALIVE || state == SWIM_SUSPECT {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (swim *Swim) randomMembers(k int, exclude int) []int {
+	candidates := []int{}
+	for _, id := range swim.liveMembers() {
+		if id != exclude {
+			candidates = append(candidates, id)
+		}
+	}
+	swim.rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > k {
+		candidates = candidates[:k]
+	}
+	return candidates
+}
+
+func (swim *Swim) handleMessage(msg *SwimMessage) {
+	member, known := swim.members[msg.SenderId]
+	known = known && (member.State == SWIM_ALIVE || member.State == SWIM_SUSPECT)
+	for _, update := range msg.Updates {
+		swim.apply(update)
+	}
+	switch msg.MsgType {
+	case SWIM_PING:
+		ack := SwimMessage{SenderId: swim.id, MsgType: SWIM_ACK, Seq: msg.Seq, TargetId: swim.id}
+		if !known {
+			// a stranger is joining, tell it everything we know
+			ack.Updates = swim.fullState()
+		}
+		swim.send(msg.SenderId, ack)
+	case SWIM_PINGREQ:
+		seq := swim.newSeq()
+		swim.forwards[seq] = swimForward{msg.SenderId, msg.Seq, msg.TargetId, swim.clock.Now()}
+		swim.send(msg.TargetId, SwimMessage{SenderId: swim.id, MsgType: SWIM_PING, Seq: seq, TargetId: msg.TargetId})
+	case SWIM_ACK:
+		if forward, ok := swim.forwards[msg.Seq]; ok && forward.target == msg.TargetId {
+			delete(swim.forwards, msg.Seq)
+			swim.send(forward.requester, SwimMessage{SenderId: swim.id, MsgType: SWIM_ACK, Seq: forward.seq, TargetId: forward.target})
+			return
+		}
+		if swim.probe != nil && swim.probe.seq == msg.Seq && swim.probe.target == msg.TargetId {
+			swim.probe.acked = true
+		}
+	}
+}
+
+// apply merges gossip into our view. Newer incarnations win, within one
+//   incarnation suspect beats alive and dead or left beat both.
+func (swim *Swim) apply(update SwimUpdate) {
+	if update.NodeId == swim.id {
+		if (update.State == SWIM_SUSPECT || update.State == SWIM_DEAD) && update.Incarnation >= swim.incarnation && !swim.leaving {
+			swim.incarnation = update.Incarnation + 1
+			fmt.Println("swim", swim.id, "refuting", update.State, "with incarnation", swim.incarnation)
+			swim.enqueue(swim.selfUpdate(SWIM_ALIVE))
+		}
+		return
+	}
+	member, ok := swim.members[update.NodeId]
+	if !ok {
+		if update.State != SWIM_ALIVE && update.State != SWIM_SUSPECT {
+			return
+		}
+		if update.Address != "" {
+			swim.net.SetNodeAddress(update.NodeId, update.Address)
+		}
+		member = &swimMember{SwimMember: SwimMember{Id: update.NodeId, Address: update.Address, State: SWIM_ALIVE, Incarnation: update.Incarnation}}
+		swim.members[update.NodeId] = member
+		swim.enqueue(SwimUpdate{update.NodeId, update.Address, SWIM_ALIVE, update.Incarnation})
+		swim.emit(SWIM_JOIN, member)
+		if update.State == SWIM_SUSPECT {
+			swim.suspect(member, update.Incarnation)
+		}
+		return
+	}
+	switch update.State {
+	case SWIM_ALIVE:
+		if update.Incarnation <= member.Incarnation {
+			return
+		}
+		rejoined := member.State == SWIM_DEAD || member.State == SWIM_LEFT
+		if update.Address != "" && update.Address != member.Address {
+			member.Address = update.Address
+			swim.net.SetNodeAddress(update.NodeId, update.Address)
+		}
+		swim.setState(member, SWIM_ALIVE, update.Incarnation)
+		if rejoined {
+			swim.emit(SWIM_JOIN, member)
+		}
+	case SWIM_SUSPECT:
+		if member.State == SWIM_ALIVE && update.Incarnation >= member.Incarnation ||
+			member.State == SWIM_SUSPECT && update.Incarnation > member.Incarnation {
+			swim.suspect(member, update.Incarnation)
+		}
+	case SWIM_DEAD, SWIM_LEFT:
+		if member.State == SWIM_DEAD || member.State == SWIM_LEFT || update.Incarnation < member.Incarnation {
+			return
+		}
+		swim.setState(member, update.State, update.Incarnation)
+	}
+}
+
+func (swim *Swim) suspect(member *swimMember, incarnation int) {
+	util.Logger.Println("swim", swim.id, "suspects", member.Id)
+	member.suspectedAt = swim.clock.Now()
+	swim.setState(member, SWIM_SUSPECT, incarnation)
+}
+
+// setState changes what we know about member, gossips it and raises the
+//   matching event
+func (swim *Swim) setState(member *swimMember, state SwimState, incarnation int) {
+	member.State = state
+	member.Incarnation = incarnation
+	swim.enqueue(SwimUpdate{member.Id, member.Address, state, incarnation})
+	switch state {
+	case SWIM_DEAD:
+		swim.emit(SWIM_FAIL, member)
+	case SWIM_LEFT:
+		swim.emit(SWIM_LEAVE, member)
+	}
+}
+
+func (swim *Swim) emit(kind SwimEventKind, member *swimMember) {
+	swim.events = append(swim.events, SwimEvent{kind, member.SwimMember})
+}
+
+func (swim *Swim) selfUpdate(state SwimState) SwimUpdate {
+	return SwimUpdate{swim.id, swim.address, state, swim.incarnation}
+}
+
+func (swim *Swim) fullState() []SwimUpdate {
+	updates := []SwimUpdate{swim.selfUpdate(SWIM_ALIVE)}
+	for _, id := range sortedKeys(swim.members) {
+		member := swim.members[id]
+		updates = append(updates, SwimUpdate{id, member.Address, member.State, member.Incarnation})
+	}
+	return updates
+}
+
+// enqueue replaces any gossip about the same node
+func (swim *Swim) enqueue(update SwimUpdate) {
+	swim.gossip[update.NodeId] = &swimGossip{update: update}
+}
+
+// piggyback picks the least sent updates, and forgets the ones sent often
+//   enough to have reached everyone
+func (swim *Swim) piggyback() []SwimUpdate {
+	limit := swim.retransmitMult * int(math.Ceil(math.Log10(float64(len(swim.members)+2))))
+	ids := sortedKeys(swim.gossip)
+	sort.SliceStable(ids, func(i, j int) bool { return swim.gossip[ids[i]].sent < swim.gossip[ids[j]].sent })
+	updates := []SwimUpdate{}
+	for _, id := range ids {
+		if len(updates) == swim.maxPiggyback {
+			break
+		}
+		gossip := swim.gossip[id]
+		updates = append(updates, gossip.update)
+		gossip.sent++
+		if gossip.sent >= limit {
+			delete(swim.gossip, id)
+		}
+	}
+	return updates
+}
+
+func (swim *Swim) send(id int, msg SwimMessage) {
+	msg.Updates = append(msg.Updates, swim.piggyback()...)
+	if err := swim.net.Send(id, msg); err != nil {
+		util.Logger.Println("swim", swim.id, "could not send to", id, err)
+	}
+}
+
+func (swim *Swim) newSeq() int {
+	swim.nextSeq++
+	return swim.nextSeq
+}
@@ -0,0 +1,105 @@
+package protocols
+
+import (
+	"flads/util"
+	"time"
+)
+
+// The leader does not propose every write request on its own. Requests
+//   are gathered into a batch that is proposed once it holds maxBatchSize
+//   gradients or its oldest gradient has waited batchWindow, and up to
+//   maxInFlight proposals can be waiting for acks at once. Proposals are
+//   still committed strictly in zxid order.
+
+type zabInFlight struct {
+	zxid ZabZxid
+	acks map[int]bool
+}
+
+// SetBatching configures write batching on the leader. A maxBatchSize of 1
+//   and a maxInFlight of 1 gives one round trip per write request.
+func (node *ZabNode) SetBatching(window time.Duration, maxBatchSize int, maxInFlight int) {
+	node.batchWindow = window
+	node.maxBatchSize = maxBatchSize
+	node.maxInFlight = maxInFlight
+}
+
+func (node *ZabNode) addToBatch(write ZabWrite) {
+	if len(node.batch) == 0 {
+		node.batchStarted = node.clock.Now()
+	}
+	node.batch = append(node.batch, write)
+	if len(node.batch) >= node.maxBatchSize {
+		node.flushBatch()
+	}
+}
+
+// batchTick proposes the pending batch once its window is up
+func (node *ZabNode) batchTick() {
+	if len(node.batch) > 0 && node.clock.Now().Sub(node.batchStarted) >= node.batchWindow {
+		node.flushBatch()
+	}
+}
+
+// flushBatch proposes the pending batch, unless the pipeline is full, in
+//   which case the batch keeps growing until a proposal commits
+func (node *ZabNode) flushBatch() {
+	if len(node.batch) == 0 || len(node.inFlight) >= node.maxInFlight {
+		return
+	}
+
+	proposal := ZabProposalAckCommit{
+		Epoch:   node.currentEpoch,
+		Counter: node.leaderCounter,
+		Batch:   node.batch,
+		Config:  node.proposedConfig(node.batch),
+	}
+	node.leaderCounter += 1
+	node.batch = nil
+
+	if err := node.storage.AppendProposal(proposal); err != nil {
+		util.Logger.Println("failed to persist proposal:", err)
+	}
+	node.history = append(node.history, proposal)
+	node.inFlight = append(node.inFlight, zabInFlight{proposal.zxid(), make(map[int]bool)})
+	util.Logger.Println("broadcasting with counter", proposal.Counter, "and", len(proposal.Batch), "writes")
+	node.broadcastToVoters(ZabMessage{
+		SenderId:             node.id,
+		MsgType:              PROPOSAL,
+		ZabProposalAckCommit: proposal,
+	})
+
+	// a single node ensemble is its own quorum
+	node.commitAcked()
+}
+
+// commitAcked commits in-flight proposals from the front of the pipeline
+//   for as long as they have a quorum of acks. A later proposal with a
+//   quorum waits for the ones before it.
+func (node *ZabNode) commitAcked() {
+	committed := false
+	for len(node.inFlight) > 0 {
+		head := node.inFlight[0]
+		if !node.isQuorum(append(sortedKeys(head.acks), node.id)) {
+			break
+		}
+		// like an INFORM, a commit names the one before it so followers
+		//   notice when they missed something
+		node.broadcastToVoters(ZabMessage{
+			SenderId:             node.id,
+			MsgType:              COMMIT,
+			ZabProposalAckCommit: ZabProposalAckCommit{Epoch: head.zxid.Epoch, Counter: head.zxid.Counter},
+			ZabViewChange: ZabViewChange{
+				LastZxid: node.lastCommitted,
+			},
+		})
+		node.informObservers(head.zxid)
+		node.commitThrough(head.zxid)
+		node.inFlight = node.inFlight[1:]
+		committed = true
+	}
+	if committed {
+		// a slot opened up, the batch may have been waiting for it
+		node.flushBatch()
+	}
+}
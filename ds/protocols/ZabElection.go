@@ -0,0 +1,254 @@
+package protocols
+
+import (
+	"flads/util"
+	"fmt"
+	"time"
+)
+
+// Phase 0: leader election, modelled on ZooKeeper's Fast Leader Election.
+//   Every looking node starts by voting for itself and broadcasts its
+//   vote. Whenever it hears a better vote for the same round it adopts it
+//   and rebroadcasts. Votes are ordered by (currentEpoch, lastZxid, id), so
+//   the winner always has the most up-to-date history. Once a quorum agrees
+//   with its own vote, the node waits finalizeWait for a better vote to
+//   show up and then moves into discovery with that leader.
+
+type ZabVote struct {
+	LeaderId     int
+	CurrentEpoch int
+	LastZxid     ZabZxid
+	Round        int
+
+	// false if the sender already left the election, in which case
+	//   LeaderId is the leader it is following (or is itself)
+	Looking bool
+}
+
+type ZabZxid struct {
+	Epoch   int
+	Counter int
+}
+
+// better reports whether vote a should win over vote b
+func (a ZabVote) better(b ZabVote) bool {
+	if a.CurrentEpoch != b.CurrentEpoch {
+		return a.CurrentEpoch > b.CurrentEpoch
+	}
+	if a.LastZxid.Epoch != b.LastZxid.Epoch {
+		return a.LastZxid.Epoch > b.LastZxid.Epoch
+	}
+	if a.LastZxid.Counter != b.LastZxid.Counter {
+		return a.LastZxid.Counter > b.LastZxid.Counter
+	}
+	return a.LeaderId > b.LeaderId
+}
+
+func (a ZabVote) sameLeader(b ZabVote) bool {
+	return a.LeaderId == b.LeaderId && a.CurrentEpoch == b.CurrentEpoch && a.LastZxid == b.LastZxid
+}
+
+func (node *ZabNode) selfVote() ZabVote {
+	epoch, counter := node.getLastZxid()
+	return ZabVote{
+		LeaderId:     node.id,
+		CurrentEpoch: node.currentEpoch,
+		LastZxid:     ZabZxid{epoch, counter},
+		Round:        node.electionRound,
+		Looking:      true,
+	}
+}
+
+func (node *ZabNode) startElection() {
+	fmt.Println("Entering phase 0, starting election")
+	node.phase = 0
+	node.reset = false
+	node.electionRound++
+	node.clearLeaderState()
+	node.stopHeartbeat()
+
+	node.vote = node.selfVote()
+	node.receivedVotes = map[int]ZabVote{node.id: node.vote}
+	node.outOfElection = make(map[int]ZabVote)
+	node.hasVoteQuorum = false
+	node.broadcastVote()
+}
+
+// clearLeaderState forgets everything from the previous epoch's recovery
+//   and broadcast
+func (node *ZabNode) clearLeaderState() {
+	node.followerInfos = make(map[int]int)
+	node.followerAckEpochs = make(map[int]*ZabViewChange)
+	node.followerAckNewLeaders = make(map[int]bool)
+	node.newEpochProposed = false
+	node.batch = nil
+	node.inFlight = nil
+	node.observing = make(map[int]bool)
+	node.transferTarget = -1
+	node.leaseGrants = make(map[int]time.Time)
+}
+
+func (node *ZabNode) broadcastVote() {
+	node.lastVoteSent = node.clock.Now()
+	err := node.broadcastToVoters(ZabMessage{
+		SenderId: node.id,
+		MsgType:  VOTE,
+		Vote:     node.vote,
+	})
+	if err != nil {
+		util.Logger.Println("error broadcasting vote:", err)
+	}
+}
+
+// electionTick resends our vote if the election is not making progress,
+//   in case notifications were lost or a peer has only just come up
+func (node *ZabNode) electionTick() {
+	now := node.clock.Now()
+	if node.hasVoteQuorum && now.Sub(node.voteQuorumAt) >= node.finalizeWait {
+		node.finishElection(node.vote.LeaderId)
+		return
+	}
+	if now.Sub(node.lastVoteSent) >= node.electionTimeout {
+		node.broadcastVote()
+	}
+}
+
+func (node *ZabNode) handleVote(msg *ZabMessage) {
+	if node.phase != 0 {
+		// Not looking: tell the sender who we follow so it can join us.
+		//   Never answer an answer, or two settled nodes go back and forth.
+		if !msg.Vote.Looking {
+			return
+		}
+		node.SendHelper(msg.SenderId, ZabMessage{
+			SenderId: node.id,
+			MsgType:  VOTE,
+			Vote: ZabVote{
+				LeaderId:     node.leaderId,
+				CurrentEpoch: node.currentEpoch,
+				Round:        node.electionRound,
+				Looking:      false,
+			},
+		})
+		return
+	}
+
+	vote := msg.Vote
+	if vote.Looking && !node.isVoter(msg.SenderId) {
+		// a node that has not been added yet must not become leader
+		return
+	}
+	if !vote.Looking {
+		node.outOfElection[msg.SenderId] = vote
+		node.checkOutOfElection(vote.LeaderId)
+		return
+	}
+
+	if vote.Round > node.electionRound {
+		// we are behind, restart our vote in the newer round
+		node.electionRound = vote.Round
+		node.receivedVotes = make(map[int]ZabVote)
+		node.vote = node.selfVote()
+		if vote.better(node.vote) {
+			node.vote.LeaderId = vote.LeaderId
+			node.vote.CurrentEpoch = vote.CurrentEpoch
+			node.vote.LastZxid = vote.LastZxid
+		}
+		node.hasVoteQuorum = false
+		node.broadcastVote()
+	} else if vote.Round < node.electionRound {
+		// the sender is behind, bring it up to our round
+		node.SendHelper(msg.SenderId, ZabMessage{
+			SenderId: node.id,
+			MsgType:  VOTE,
+			Vote:     node.vote,
+		})
+		return
+	} else if vote.better(node.vote) {
+		node.vote.LeaderId = vote.LeaderId
+		node.vote.CurrentEpoch = vote.CurrentEpoch
+		node.vote.LastZxid = vote.LastZxid
+		node.hasVoteQuorum = false
+		node.broadcastVote()
+	}
+
+	node.receivedVotes[msg.SenderId] = vote
+	node.receivedVotes[node.id] = node.vote
+
+	agreeing := make([]int, 0)
+	for _, nodeId := range sortedKeys(node.receivedVotes) {
+		if node.receivedVotes[nodeId].sameLeader(node.vote) {
+			agreeing = append(agreeing, nodeId)
+		}
+	}
+	if !node.isQuorum(agreeing) {
+		node.hasVoteQuorum = false
+	} else if !node.hasVoteQuorum {
+		node.hasVoteQuorum = true
+		node.voteQuorumAt = node.clock.Now()
+	}
+}
+
+// checkOutOfElection joins an already established leader, which is only
+//   safe if the leader itself says it leads and, counting us, a quorum
+//   follows it
+func (node *ZabNode) checkOutOfElection(leaderId int) {
+	leaderVote, ok := node.outOfElection[leaderId]
+	if !ok || leaderVote.LeaderId != leaderId {
+		return
+	}
+
+	following := []int{node.id}
+	for _, nodeId := range sortedKeys(node.outOfElection) {
+		if node.outOfElection[nodeId].LeaderId == leaderId {
+			following = append(following, nodeId)
+		}
+	}
+	if node.isQuorum(following) {
+		node.finishElection(leaderId)
+	}
+}
+
+func (node *ZabNode) finishElection(leaderId int) {
+	node.leaderId = leaderId
+	node.phase = 1
+	node.phaseDeadline = node.clock.Now().Add(node.recoveryTimeout)
+	fmt.Println("elected leader", leaderId, "in round", node.electionRound, "- entering phase 1")
+	if leaderId != node.id {
+		node.sendFollowerInfo()
+	}
+}
+
+func (node *ZabNode) sendFollowerInfo() {
+	node.lastFollowerInfoSent = node.clock.Now()
+	if node.promisedElsewhere(node.leaderId) {
+		util.Logger.Println("not following", node.leaderId, "before the lease we granted", node.leaseHolder, "runs out")
+		return
+	}
+	// LastZxid lets a leader that is already broadcasting sync us directly
+	epoch, counter := node.getLastZxid()
+	node.SendHelper(node.leaderId, ZabMessage{
+		SenderId: node.id,
+		Epoch:    node.acceptedEpoch,
+		MsgType:  FOLLOWERINFO,
+		ZabViewChange: ZabViewChange{
+			LastZxid: ZabZxid{epoch, counter},
+		},
+	})
+}
+
+// recoveryTick runs while a node is in discovery or synchronization. A
+//   follower keeps resending FOLLOWERINFO until the leader answers (the
+//   leader may not have finished its own election yet), and anyone who
+//   spends too long recovering goes back to election.
+func (node *ZabNode) recoveryTick() {
+	now := node.clock.Now()
+	if now.After(node.phaseDeadline) {
+		fmt.Println("recovery timed out in phase", node.phase)
+		node.reset = true
+		return
+	}
+	if node.leaderId != node.id && now.Sub(node.lastFollowerInfoSent) >= node.electionTimeout {
+		node.sendFollowerInfo()
+	}
+}
@@ -0,0 +1,199 @@
+package protocols
+
+import (
+	"errors"
+	"flads/ml"
+	"flads/util"
+	"sort"
+	"time"
+)
+
+// Leader leases let the leader answer reads from its own state. Every
+//   leader heartbeat carries a lease expiry on the leader's clock, and a
+//   follower that takes the heartbeat echoes the expiry back, which
+//   promises the leader that the follower will not help any other leader
+//   into a new epoch before then. Once a quorum has promised up to some
+//   time, no other leader can commit anything until that time, so until
+//   it (minus maxClockDrift for the follower clocks) everything committed
+//   anywhere is committed at the leader.
+//
+//   The promise is kept by holding back FOLLOWERINFO, and the proposal of
+//   a new epoch, while a lease granted to another node runs. A leader
+//   that hands over leadership gives up its lease first.
+//
+//   Sync lets any node catch up to the leader's commit point: the leader
+//   answers with its last committed zxid while it holds a lease, and the
+//   result is done once this node has applied that zxid.
+//
+//   Grants are recorded by heartbeatTick on Run, so like everything else on
+//   the node, reads and syncs have to come from the goroutine driving Run.
+
+var ErrNoLease = errors.New("not the leader or lease expired")
+var ErrNoModel = errors.New("not replicating a model")
+
+type ZabSyncResult struct {
+	Done bool
+	// applied on this node when the sync completed
+	Zxid ZabZxid
+}
+
+type zabPendingSync struct {
+	result  *ZabSyncResult
+	done    func()
+	sentAt  time.Time
+	replied bool
+	target  ZabZxid
+}
+
+// ReadModel returns the latest committed weights and the zxid they
+//   reflect, as long as this node is the leader and holds a lease. A node
+//   with its own state machine has no model, use ReadCommitted there.
+func (node *ZabNode) ReadModel() (ml.MLPWeights, ZabZxid, error) {
+	if node.ml == nil {
+		return ml.MLPWeights{}, ZabZxid{}, ErrNoModel
+	}
+	if !node.hasLease() {
+		return ml.MLPWeights{}, ZabZxid{}, ErrNoLease
+	}
+	return node.ml.GetWeights(), node.lastCommitted, nil
+}
+
+// ReadCommitted returns the latest committed zxid under the same
+//   conditions as ReadModel
+func (node *ZabNode) ReadCommitted() (ZabZxid, error) {
+	if !node.hasLease() {
+		return ZabZxid{}, ErrNoLease
+	}
+	return node.lastCommitted, nil
+}
+
+func (node *ZabNode) hasLease() bool {
+	if node.phase != 3 || node.leaderId != node.id || node.transferTarget != -1 || node.removed {
+		return false
+	}
+	return node.clock.Now().Before(node.leaseExpiry().Add(-node.maxClockDrift))
+}
+
+// leaseExpiry is the latest time a quorum of every config has promised
+//   to follow us until, counting our own promise to ourselves
+func (node *ZabNode) leaseExpiry() time.Time {
+	grants := map[int]time.Time{node.id: node.clock.Now().Add(node.leaseDuration)}
+	for id, expiry := range node.leaseGrants {
+		grants[id] = expiry
+	}
+	times := make([]time.Time, 0, len(grants))
+	for _, expiry := range grants {
+		times = append(times, expiry)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].After(times[j]) })
+	for _, t := range times {
+		ids := []int{}
+		for _, id := range sortedKeys(grants) {
+			if !grants[id].Before(t) {
+				ids = append(ids, id)
+			}
+		}
+		if node.isQuorum(ids) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (node *ZabNode) recordLeaseGrant(hb ZabHeartbeat) {
+	if hb.LeaseExpiry.After(node.leaseGrants[hb.SenderId]) {
+		node.leaseGrants[hb.SenderId] = hb.LeaseExpiry
+	}
+}
+
+// promisedElsewhere reports whether we granted a lease that is still
+//   running to someone other than leaderId
+func (node *ZabNode) promisedElsewhere(leaderId int) bool {
+	return node.leaseHolder != leaderId && node.clock.Now().Before(node.leaderLease)
+}
+
+// Sync returns a result that is done once this node has applied
+//   everything the leader had committed when it got the request
+func (node *ZabNode) Sync() *ZabSyncResult {
+	return node.syncThen(nil)
+}
+
+// syncThen is Sync that also calls done, unless it is nil, once the sync
+//   completes
+func (node *ZabNode) syncThen(done func()) *ZabSyncResult {
+	result := &ZabSyncResult{}
+	node.nextSyncId++
+	node.syncs[node.nextSyncId] = &zabPendingSync{result: result, done: done}
+	node.syncTick()
+	return result
+}
+
+// syncTick (re)sends the syncs the leader has not answered, and completes
+//   the ones we have caught up on
+func (node *ZabNode) syncTick() {
+	node.completeSyncs()
+	now := node.clock.Now()
+	for _, id := range sortedKeys(node.syncs) {
+		sync := node.syncs[id]
+		if sync.replied {
+			continue
+		}
+		if node.hasLease() {
+			sync.replied = true
+			sync.target = node.lastCommitted
+			continue
+		}
+		if node.phase != 3 || node.leaderId == node.id || (!sync.sentAt.IsZero() && now.Sub(sync.sentAt) < node.writeRetryTimeout) {
+			continue
+		}
+		sync.sentAt = now
+		node.SendHelper(node.leaderId, ZabMessage{
+			SenderId: node.id,
+			Epoch:    node.currentEpoch,
+			MsgType:  SYNC,
+			SyncId:   id,
+		})
+	}
+	node.completeSyncs()
+}
+
+// handleSync answers while we hold a lease, otherwise the sender retries
+func (node *ZabNode) handleSync(msg *ZabMessage) {
+	if !node.hasLease() {
+		util.Logger.Println("not answering sync from", msg.SenderId, "without a lease")
+		return
+	}
+	node.SendHelper(msg.SenderId, ZabMessage{
+		SenderId: node.id,
+		Epoch:    node.currentEpoch,
+		MsgType:  SYNCREPLY,
+		SyncId:   msg.SyncId,
+		ZabViewChange: ZabViewChange{
+			LastZxid: node.lastCommitted,
+		},
+	})
+}
+
+func (node *ZabNode) handleSyncReply(msg *ZabMessage) {
+	sync, ok := node.syncs[msg.SyncId]
+	if !ok || sync.replied || msg.SenderId != node.leaderId {
+		return
+	}
+	sync.replied = true
+	sync.target = msg.LastZxid
+	node.completeSyncs()
+}
+
+func (node *ZabNode) completeSyncs() {
+	for _, id := range sortedKeys(node.syncs) {
+		sync := node.syncs[id]
+		if sync.replied && !sync.target.after(node.lastCommitted) {
+			sync.result.Zxid = node.lastCommitted
+			sync.result.Done = true
+			delete(node.syncs, id)
+			if sync.done != nil {
+				sync.done()
+			}
+		}
+	}
+}
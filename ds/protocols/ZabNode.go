@@ -22,6 +22,20 @@ const (
 	NEWLEADER       = "NEWLEADER"
 	ACKNEWLEADER    = "ACKNEWLEADER"
 	COMMITNEWLEADER = "COMMITNEWLEADER"
+	VOTE            = "VOTE"
+	OBSERVERINFO    = "OBSERVERINFO"
+	INFORM          = "INFORM"
+	TRANSFER        = "TRANSFER"
+	TRANSFERACK     = "TRANSFERACK"
+	STEPDOWN        = "STEPDOWN"
+	SYNC            = "SYNC"
+	SYNCREPLY       = "SYNCREPLY"
+)
+
+// names of the state machines a ZabNode replicates by default
+const (
+	zabModel = "model"
+	zabKV    = "kv"
 )
 
 type ZabMessage struct {
@@ -30,21 +44,39 @@ type ZabMessage struct {
 	MsgType  MsgType
 	ZabProposalAckCommit
 	ZabViewChange
+	Vote ZabVote
+	// matches a SYNCREPLY to its SYNC
+	SyncId int
 }
 
+// Write carries a single write request, Batch the writes of a proposal.
+//   Acks and commits only carry the zxid.
 type ZabProposalAckCommit struct {
 	Epoch   int
 	Counter int
-	Grads   ml.Gradients
+	Write   ZabWrite
+	Batch   []ZabWrite
+	// set on proposals that change the members
+	Config *ZabConfig
 }
 
 type ZabViewChange struct {
+	Sync         ZabSyncMode
+	Snapshot     *ZabSnapshot
+	TruncZxid    ZabZxid
 	History      []ZabProposalAckCommit
 	CurrentEpoch int
-	LastZxid     struct {
-		Epoch   int
-		Counter int
-	}
+	LastZxid     ZabZxid
+}
+
+// Heartbeats go over their own network. LeaseExpiry is how long the
+//   leader may count on still leading when it sent the heartbeat.
+type ZabHeartbeat struct {
+	SenderId      int
+	Epoch         int
+	LeaderId      int
+	LastCommitted ZabZxid
+	LeaseExpiry   time.Time
 }
 
 type ZabNode struct {
@@ -54,34 +86,118 @@ type ZabNode struct {
 	name            string
 	leaderId        int
 	ml              ml.MLProcess
+	sm              StateMachine
+	machines        *StateMachineMux
+	kv              *KVStore
 	net             network.Network[ZabMessage]
-	heartbeatNet    network.Network[int]
+	heartbeatNet    network.Network[ZabHeartbeat]
 	leaderCounter   int
 	proposalCounter int
 	commitEpoch     int
 	commitCounter   int
 	history         []ZabProposalAckCommit
 	pendingCommits  map[int]map[int]*ZabProposalAckCommit
-	ackCounter      []int
-	heartbeats      []time.Time
-	timeout         time.Duration
-	phase           int
-	acceptedEpoch   int
-	currentEpoch    int
-	reset           bool
+	heldCommits     map[ZabZxid]ZabZxid
+	commitGapSince  time.Time
+	leaderCommitted ZabZxid
+	syncedThrough   ZabZxid
+	detector        FailureDetector
+	heartbeating    bool
+	nextHeartbeat   time.Time
+	receiveTimeout  time.Duration
+	heartbeatPeriod time.Duration
+	leaseDuration   time.Duration
+	maxClockDrift   time.Duration
+	// the lease we last granted, see ZabLease.go
+	leaderLease   time.Time
+	leaseHolder   int
+	clock         util.Clock
+	storage       ZabStorage
+	phase         int
+	acceptedEpoch int
+	currentEpoch  int
+	reset         bool
+
+	// election and recovery
+	electionRound        int
+	vote                 ZabVote
+	receivedVotes        map[int]ZabVote
+	outOfElection        map[int]ZabVote
+	lastVoteSent         time.Time
+	electionTimeout      time.Duration
+	hasVoteQuorum        bool
+	voteQuorumAt         time.Time
+	finalizeWait         time.Duration
+	lastFollowerInfoSent time.Time
+	phaseDeadline        time.Time
+	recoveryTimeout      time.Duration
 
 	// leader
 	followerInfos         map[int]int
 	followerAckEpochs     map[int]*ZabViewChange
 	followerAckNewLeaders map[int]bool
+	newEpochProposed      bool
+	batch                 []ZabWrite
+	batchStarted          time.Time
+	batchWindow           time.Duration
+	maxBatchSize          int
+	inFlight              []zabInFlight
+	maxInFlight           int
+	transferTarget        int
+	leaseGrants           map[int]time.Time
+	transferStarted       time.Time
+	lastTransferSent      time.Time
+
+	// sessions, sessions is replicated state, the rest is local
+	sessions          map[ZabSession]int
+	session           ZabSession
+	nextSeq           int
+	uncommitted       []ZabWrite
+	lastWriteProgress time.Time
+	writeRetryTimeout time.Duration
+	proposedSeqs      map[ZabSession]int
+	heldWrites        map[ZabSession]map[int]ZabWrite
+	latency           commitLatency
+	syncs             map[int]*zabPendingSync
+	nextSyncId        int
+
+	// gradients produced during recovery
+	pending        []ml.Gradients
+	recoveryPolicy ZabRecoveryPolicy
+	maxPending     int
+
+	// members
+	config    ZabConfig
+	reconfigs map[int]*ZabReconfigResult
+	removed   bool
+	observing map[int]bool
+
+	// observer
+	pendingInforms map[ZabZxid]ZabProposalAckCommit
+	informGapSince time.Time
+
+	// snapshots
+	snapshot             *ZabSnapshot
+	snapshotInterval     int
+	commitsSinceSnapshot int
+	lastCommitted        ZabZxid
 }
 
-func (node *ZabNode) Initialize(id int, name string, mlp ml.MLProcess, net network.Network[ZabMessage], heartbeatNet network.Network[int], numNodes int, leaderId int) {
+func (node *ZabNode) Initialize(id int, name string, mlp ml.MLProcess, net network.Network[ZabMessage], heartbeatNet network.Network[ZabHeartbeat], numNodes int, leaderId int) {
 	node.id = id
 	node.numNodes = numNodes
 	node.name = name
 	node.leaderId = leaderId
 	node.ml = mlp
+	// the model and the metadata store share the log, so the model picks
+	//   up hyperparameter changes in log order
+	node.machines = MakeStateMachineMux()
+	node.kv = MakeKVStore(id, node.submitTo(zabKV), func(done func()) { node.syncThen(done) }, func() time.Time { return node.clock.Now() })
+	model := MakeGradientStateMachine(mlp)
+	model.SetHyperparameters(func() (ml.Hyperparameters, bool) { return CommittedHyperparameters(node.kv) })
+	node.machines.Add(zabModel, model)
+	node.machines.Add(zabKV, node.kv)
+	node.sm = node.machines
 	node.net = net
 	node.heartbeatNet = heartbeatNet
 	node.leaderCounter = 0
@@ -89,8 +205,36 @@ func (node *ZabNode) Initialize(id int, name string, mlp ml.MLProcess, net netwo
 	node.commitEpoch = 0
 	node.commitCounter = 0
 	node.pendingCommits = make(map[int]map[int]*ZabProposalAckCommit)
-	node.timeout = 5 * time.Second
-	node.heartbeats = make([]time.Time, numNodes)
+	node.heldCommits = make(map[ZabZxid]ZabZxid)
+	node.receiveTimeout = 50 * time.Millisecond
+	node.heartbeatPeriod = 100 * time.Millisecond
+	node.leaseDuration = time.Second
+	node.maxClockDrift = 100 * time.Millisecond
+	node.leaseHolder = -1
+	node.leaseGrants = make(map[int]time.Time)
+	node.syncs = make(map[int]*zabPendingSync)
+	node.electionTimeout = 200 * time.Millisecond
+	node.finalizeWait = 200 * time.Millisecond
+	node.recoveryTimeout = 10 * time.Second
+	node.clock = util.SystemClock
+	node.storage = &MemoryZabStorage{}
+	node.snapshotInterval = 100
+	node.batchWindow = 20 * time.Millisecond
+	node.maxBatchSize = 8
+	node.maxInFlight = 4
+	node.sessions = make(map[ZabSession]int)
+	node.writeRetryTimeout = time.Second
+	node.recoveryPolicy = ACCUMULATE
+	node.maxPending = 16
+	node.proposedSeqs = make(map[ZabSession]int)
+	node.heldWrites = make(map[ZabSession]map[int]ZabWrite)
+	node.lastCommitted = ZabZxid{-1, -1}
+	node.leaderCommitted = ZabZxid{-1, -1}
+	node.detector = MakePhiAccrualDetector(DefaultPhiAccrualConfig())
+	node.config = initialZabConfig(numNodes)
+	node.reconfigs = make(map[int]*ZabReconfigResult)
+	node.observing = make(map[int]bool)
+	node.pendingInforms = make(map[ZabZxid]ZabProposalAckCommit)
 	node.phase = 0
 	node.acceptedEpoch = 0
 	node.currentEpoch = 0
@@ -98,56 +242,120 @@ func (node *ZabNode) Initialize(id int, name string, mlp ml.MLProcess, net netwo
 	node.reset = true
 	node.followerAckEpochs = make(map[int]*ZabViewChange)
 	node.followerAckNewLeaders = make(map[int]bool)
+	node.transferTarget = -1
+}
+
+func (node *ZabNode) SetClock(clock util.Clock) {
+	node.clock = clock
+}
+
+// SetStateMachine replicates sm instead of the model and the metadata
+//   store. Commands then only come from Submit, mlp is no longer asked for
+//   gradients and KV returns nil. Must be called before SetStorage and Run.
+func (node *ZabNode) SetStateMachine(sm StateMachine) {
+	node.sm = sm
+	node.machines = nil
+	node.kv = nil
+	node.ml = nil
+}
+
+// KV returns the metadata store replicated alongside the model
+func (node *ZabNode) KV() *KVStore {
+	return node.kv
+}
+
+// submitTo returns a function that submits commands for one of the state
+//   machines in node.machines
+func (node *ZabNode) submitTo(name string) func(command []byte) {
+	return func(command []byte) {
+		tagged, err := node.machines.Command(name, command)
+		if err != nil {
+			util.Logger.Println("failed to tag command for", name, err)
+			return
+		}
+		node.Submit(tagged)
+	}
+}
+
+// SetStorage switches the node to storage and recovers the epochs and
+//   history saved in it, so a restarted node rejoins with its old state.
+//   Must be called before Run.
+func (node *ZabNode) SetStorage(storage ZabStorage) error {
+	acceptedEpoch, currentEpoch, err := storage.LoadEpochs()
+	if err != nil {
+		return fmt.Errorf("loading epochs: %v", err)
+	}
+	history, err := storage.LoadHistory()
+	if err != nil {
+		return fmt.Errorf("loading history: %v", err)
+	}
+	snapshot, err := storage.LoadSnapshot()
+	if err != nil {
+		return fmt.Errorf("loading snapshot: %v", err)
+	}
+
+	node.storage = storage
+	node.acceptedEpoch = acceptedEpoch
+	node.currentEpoch = currentEpoch
+	node.history = history
+	// the log may still hold proposals the snapshot covers if we crashed
+	//   between saving the snapshot and compacting
+	if err := node.installSnapshot(snapshot); err != nil {
+		return err
+	}
+	fmt.Printf("recovered acceptedEpoch %d currentEpoch %d and %d proposals\n", acceptedEpoch, currentEpoch, len(node.history))
+	return nil
 }
 
 func (node *ZabNode) Run() {
+	if node.removed {
+		return
+	}
+	if node.isObserver(node.id) {
+		node.runObserver()
+		return
+	}
 	// TODO: Outer for received {} loop, with nested phase conditions
 	if node.reset {
-		fmt.Println("in reset")
-		node.phase = 0
-		node.reset = false
-		node.leaderId = (node.leaderId + 1) % node.numNodes
-		fmt.Println("leaderId is", node.leaderId)
-		// follower sends info to leader
-		if node.leaderId != node.id {
-			node.SendHelper(node.leaderId, ZabMessage{
-				SenderId: node.id,
-				Epoch:    node.acceptedEpoch,
-				MsgType:  FOLLOWERINFO,
-			})
-		}
-		node.phase = 1
-		fmt.Println("Entering phase 1")
+		node.startElection()
 	} else {
-		if node.phase == 3 {
-			if ready, localGrads := node.ml.GetGradients(); ready {
-				err := node.SendHelper(node.leaderId, ZabMessage{
-					SenderId: node.id,
-					MsgType:  WRITE_REQUEST,
-					ZabProposalAckCommit: ZabProposalAckCommit{
-						Counter: -1, // can be anything
-						Epoch:   -1, // can be anything
-						Grads:   localGrads,
-					},
-				})
-				if err != nil {
-					util.Logger.Println("From ZabNode Run(): Msg send failed", err)
-				} else {
-					util.Logger.Println("From ZabNode Run(): sent grads to leader from", node.id)
-				}
+		if node.phase == 0 {
+			node.electionTick()
+			node.queueLocalGradients()
+		} else if node.phase == 1 || node.phase == 2 {
+			node.recoveryTick()
+			node.queueLocalGradients()
+		} else if node.phase == 3 {
+			node.heartbeatTick()
+			if node.leaderId == node.id {
+				node.batchTick()
+				node.transferTick()
+				node.pruneObservers()
 			}
+			node.writeTick()
+			node.commitGapTick()
+			node.syncTick()
+			node.submitLocalGradients()
 		}
 
-		zabMsg, received := node.ReceiveHelper()
-		for received {
-			if node.phase == 1 {
+		// Block for a bit on the first message instead of spinning, then
+		//   drain whatever else has arrived
+		zabMsg, received := node.ReceiveHelper(node.receiveTimeout)
+		for received && !node.reset {
+			if zabMsg.MsgType == VOTE {
+				node.handleVote(&zabMsg)
+			} else if node.phase == 1 {
 				switch zabMsg.MsgType {
 				case FOLLOWERINFO:
-					node.handleFollowerInfo(&zabMsg)
+					if node.leaderId == node.id {
+						node.handleFollowerInfo(&zabMsg)
+					}
 				case NEWEPOCH:
 					node.handleNewEpoch(&zabMsg)
 				case ACKEPOCH:
 					node.handleAckEpoch(&zabMsg)
+				case TRANSFER:
+					node.handleTransfer(&zabMsg)
 				default:
 					util.Logger.Println("got message type", zabMsg.MsgType, "in phase 1")
 				}
@@ -167,21 +375,35 @@ func (node *ZabNode) Run() {
 				case PROPOSAL:
 					node.handleProposal(&zabMsg)
 				case COMMIT:
-					node.handleCommit(&zabMsg.ZabProposalAckCommit)
+					node.handleCommit(&zabMsg)
 				case WRITE_REQUEST:
 					node.handleWriteRequest(&zabMsg.ZabProposalAckCommit)
 				case ACK:
-					node.handleAck(&zabMsg.ZabProposalAckCommit)
+					node.handleAck(&zabMsg)
 				case FOLLOWERINFO:
 					node.handleIncomingFollower(&zabMsg)
+				case NEWLEADER:
+					node.handleResync(&zabMsg)
 				case ACKNEWLEADER:
 					node.handleIncomingFollowerAck(&zabMsg)
+				case OBSERVERINFO:
+					node.handleObserverInfo(&zabMsg)
+				case TRANSFER:
+					node.handleTransfer(&zabMsg)
+				case TRANSFERACK:
+					node.handleTransferAck(&zabMsg)
+				case STEPDOWN:
+					node.handleStepDown(&zabMsg)
+				case SYNC:
+					node.handleSync(&zabMsg)
+				case SYNCREPLY:
+					node.handleSyncReply(&zabMsg)
 				default:
 					util.Logger.Println("got message type", zabMsg.MsgType, "in phase 3")
 				}
 				node.processPendingCommits()
 			}
-			zabMsg, received = node.ReceiveHelper()
+			zabMsg, received = node.ReceiveHelper(0)
 		}
 	}
 
@@ -198,9 +420,12 @@ func (node *ZabNode) handleNewEpoch(msg *ZabMessage) {
 		fmt.Println("return early from handleNewEpoch")
 		return
 	}
-	// note acceptedEpoch should go to non-volatile mem
 	if msg.Epoch > node.acceptedEpoch {
 		fmt.Println("Entering phase 2")
+		if err := node.storage.SaveEpochs(msg.Epoch, node.currentEpoch); err != nil {
+			util.Logger.Println("not acking epoch, failed to persist it:", err)
+			return
+		}
 		node.acceptedEpoch = msg.Epoch
 		maxEpoch, maxCounter := node.getLastZxid()
 		node.SendHelper(node.leaderId, ZabMessage{
@@ -208,12 +433,8 @@ func (node *ZabNode) handleNewEpoch(msg *ZabMessage) {
 			MsgType:  ACKEPOCH,
 			Epoch:    msg.Epoch,
 			ZabViewChange: ZabViewChange{
-				History:      node.history,
 				CurrentEpoch: node.currentEpoch,
-				LastZxid: struct {
-					Epoch   int
-					Counter int
-				}{maxEpoch, maxCounter},
+				LastZxid:     ZabZxid{maxEpoch, maxCounter},
 			},
 		})
 		node.phase = 2
@@ -230,10 +451,19 @@ func (node *ZabNode) handleNewLeader(msg *ZabMessage) {
 		fmt.Printf("handle new leader %d accEpoch: %d msgEpoch: %d \n", msg.SenderId, node.acceptedEpoch, msg.Epoch)
 		// begin atomic
 		// fmt.Println("begin atomic")
+		// history goes first, a crash in between then leaves us in the
+		//   old epoch with the new history, which the leader will fix
+		fmt.Println("syncing with", msg.Sync, "and", len(msg.History), "proposals")
+		if err := node.applySync(&msg.ZabViewChange); err != nil {
+			util.Logger.Println("not acking new leader, failed to sync:", err)
+			return
+		}
+		node.syncedThrough = msg.LastZxid
+		if err := node.storage.SaveEpochs(node.acceptedEpoch, msg.Epoch); err != nil {
+			util.Logger.Println("not acking new leader, failed to persist epoch:", err)
+			return
+		}
 		node.currentEpoch = msg.Epoch
-		// TODO: Supposed to accept the proposal, doing nothing for now
-
-		node.history = msg.History
 		// fmt.Println("end atomic")
 		// end atomic
 		node.SendHelper(node.leaderId, ZabMessage{
@@ -241,7 +471,6 @@ func (node *ZabNode) handleNewLeader(msg *ZabMessage) {
 			MsgType:  ACKNEWLEADER,
 			ZabViewChange: ZabViewChange{
 				CurrentEpoch: msg.Epoch,
-				History:      node.history,
 			},
 		})
 	} else {
@@ -251,43 +480,17 @@ func (node *ZabNode) handleNewLeader(msg *ZabMessage) {
 }
 
 func (node *ZabNode) handleCommitNewLeader(msg *ZabMessage) {
-	// TODO: this is inefficient
-	// Might be buggy but check again
-	for {
-		found := false
-		for _, local_zpac := range node.history {
-			if local_zpac.Counter == node.commitCounter+1 && local_zpac.Epoch == node.commitEpoch {
-				found = true
-				node.commit(&local_zpac)
-				break
-			}
-		}
-		if !found {
-			node.commitEpoch++
-			fmt.Println(node.commitEpoch)
-			node.commitCounter = 0
-			break
-		}
-	}
-	for {
-		found := false
-		for _, local_zpac := range node.history {
-			if local_zpac.Counter == node.commitCounter+1 && local_zpac.Epoch == node.commitEpoch {
-				found = true
-				node.commit(&local_zpac)
-				break
-			}
-		}
-		if !found {
-			// node.commitEpoch++
-			fmt.Println(node.commitEpoch)
-			// node.commitCounter = 0
-			break
-		}
-	}
+	// a follower that joins in phase 3 must not commit the proposals the
+	//   leader still has in flight, it acks them instead
+	node.commitThrough(node.syncedThrough)
+	node.ackUncommitted()
+	node.heldCommits = make(map[ZabZxid]ZabZxid)
+	node.leaderCommitted = node.lastCommitted
+	node.resendWrites()
+	node.flushPending()
 	// Go to phase 3
 	fmt.Println("go to phase 3")
-	go node.heartbeat()
+	node.startHeartbeat()
 	node.phase = 3
 }
 
@@ -304,7 +507,12 @@ func (node *ZabNode) handleProposal(p *ZabMessage) {
 	if p.SenderId != node.leaderId {
 		return
 	}
-	node.history = append(node.history, p.ZabProposalAckCommit)
+	if err := node.storage.AppendProposal(p.ZabProposalAckCommit); err != nil {
+		util.Logger.Println("not acking proposal, failed to persist it:", err)
+		return
+	}
+	node.insertProposal(p.ZabProposalAckCommit)
+	node.applyHeldCommits()
 	if p.Counter > node.proposalCounter {
 		node.proposalCounter = p.Counter
 	}
@@ -315,24 +523,168 @@ func (node *ZabNode) handleProposal(p *ZabMessage) {
 	node.SendHelper(node.leaderId, ZabMessage{
 		SenderId:             node.id,
 		MsgType:              ACK,
-		ZabProposalAckCommit: p.ZabProposalAckCommit,
+		ZabProposalAckCommit: ZabProposalAckCommit{Epoch: p.ZabProposalAckCommit.Epoch, Counter: p.Counter},
 	})
 }
 
-func (node *ZabNode) handleCommit(c *ZabProposalAckCommit) {
-	if c.Epoch > node.commitEpoch || (c.Epoch == node.commitEpoch && c.Counter > node.commitCounter+1) {
-		// wait
-		// fmt.Printf("handle commit wait, c.e: %d node.ce %d c.c %d node.cc %d\n", c.Epoch, node.commitEpoch, c.Counter, node.commitCounter)
-		// node.setFromPendingCommit(c.Epoch, c.Counter, c)
-		node.commit(c)
-	} else {
-		node.commit(c)
+// handleCommit commits once we have the proposal and the commit before
+//   it. Commits that arrive ahead of a missing proposal or commit are held
+//   back, and if we stay behind the leader for electionTimeout we ask it
+//   to resync us.
+func (node *ZabNode) handleCommit(msg *ZabMessage) {
+	if msg.SenderId != node.leaderId || !msg.zxid().after(node.lastCommitted) {
+		return
+	}
+	if !node.behindLeader() {
+		node.commitGapSince = node.clock.Now()
+	}
+	node.heldCommits[msg.LastZxid] = msg.zxid()
+	node.applyHeldCommits()
+}
+
+// applyHeldCommits commits held back commits for as long as they follow
+//   on from our last commit and we have their proposal
+func (node *ZabNode) applyHeldCommits() {
+	progressed := false
+	for {
+		zxid, ok := node.heldCommits[node.lastCommitted]
+		if !ok {
+			break
+		}
+		proposal := node.proposalAt(zxid)
+		if proposal == nil {
+			break
+		}
+		delete(node.heldCommits, node.lastCommitted)
+		node.commit(proposal)
+		progressed = true
+	}
+	for prev, zxid := range node.heldCommits {
+		if !zxid.after(node.lastCommitted) {
+			delete(node.heldCommits, prev)
+		}
+	}
+	if progressed {
+		node.commitGapSince = node.clock.Now()
+	}
+}
+
+// behindLeader reports whether the leader committed something we have
+//   not, as far as we know from its commits and heartbeats
+func (node *ZabNode) behindLeader() bool {
+	return len(node.heldCommits) > 0 || node.leaderCommitted.after(node.lastCommitted)
+}
+
+// commitGapTick asks the leader to resync a follower that fell behind. The
+//   leader answers a FOLLOWERINFO in phase 3 the way it brings in a late
+//   follower, from our last commit, so whatever we missed is sent again.
+func (node *ZabNode) commitGapTick() {
+	now := node.clock.Now()
+	if node.leaderId == node.id || !node.behindLeader() ||
+		now.Sub(node.commitGapSince) < node.electionTimeout || now.Sub(node.lastFollowerInfoSent) < node.electionTimeout {
+		return
+	}
+	fmt.Println("missed a proposal or commit, resyncing with", node.leaderId)
+	node.lastFollowerInfoSent = now
+	node.SendHelper(node.leaderId, ZabMessage{
+		SenderId: node.id,
+		Epoch:    node.acceptedEpoch,
+		MsgType:  FOLLOWERINFO,
+		ZabViewChange: ZabViewChange{
+			LastZxid: node.lastCommitted,
+		},
+	})
+}
+
+// handleResync applies the NEWLEADER the leader answers a resync with,
+//   without leaving phase 3. Proposals that came in after the leader sent
+//   it are kept, and the ones it has not committed are acked again in
+//   case our first ack was lost.
+func (node *ZabNode) handleResync(msg *ZabMessage) {
+	if msg.SenderId != node.leaderId || msg.Epoch != node.currentEpoch {
+		return
+	}
+	newer := node.historyAfter(msg.LastZxid)
+	if err := node.applySync(&msg.ZabViewChange); err != nil {
+		util.Logger.Println("failed to resync:", err)
+		return
 	}
+	for _, proposal := range newer {
+		if node.proposalAt(proposal.zxid()) == nil {
+			if err := node.storage.AppendProposal(proposal); err != nil {
+				util.Logger.Println("failed to persist proposal:", err)
+			}
+			node.insertProposal(proposal)
+		}
+	}
+	node.commitThrough(msg.LastZxid)
+	node.ackUncommitted()
+	node.applyHeldCommits()
+}
+
+// ackUncommitted acks every proposal in the history after our last commit
+func (node *ZabNode) ackUncommitted() {
+	for _, proposal := range node.historyAfter(node.lastCommitted) {
+		node.SendHelper(node.leaderId, ZabMessage{
+			SenderId:             node.id,
+			MsgType:              ACK,
+			ZabProposalAckCommit: ZabProposalAckCommit{Epoch: proposal.Epoch, Counter: proposal.Counter},
+		})
+	}
+}
+
+// commitThrough commits every proposal in the history up to and including
+//   zxid that has not been applied yet, since Zab commits in order and
+//   commits can overtake each other on the network
+func (node *ZabNode) commitThrough(zxid ZabZxid) {
+	// commit may compact node.history underneath us
+	history := node.history
+	for i := range history {
+		if !history[i].zxid().after(zxid) {
+			node.commit(&history[i])
+		}
+	}
+}
+
+func (node *ZabNode) proposalAt(zxid ZabZxid) *ZabProposalAckCommit {
+	for i := range node.history {
+		if node.history[i].zxid() == zxid {
+			return &node.history[i]
+		}
+	}
+	return nil
+}
+
+// insertProposal keeps the history in zxid order even if proposals
+//   arrive out of order, and ignores duplicates
+func (node *ZabNode) insertProposal(p ZabProposalAckCommit) {
+	i := len(node.history)
+	for i > 0 && node.history[i-1].zxid().after(p.zxid()) {
+		i--
+	}
+	if i > 0 && node.history[i-1].zxid() == p.zxid() {
+		return
+	}
+	node.history = append(node.history, ZabProposalAckCommit{})
+	copy(node.history[i+1:], node.history[i:])
+	node.history[i] = p
 }
 
 func (node *ZabNode) commit(c *ZabProposalAckCommit) {
-	node.ml.UpdateModel(c.Grads)
+	// already applied, either directly or through a snapshot
+	if !c.zxid().after(node.lastCommitted) {
+		return
+	}
+	for _, write := range c.Batch {
+		node.applyWrite(write)
+	}
+	node.lastCommitted = c.zxid()
+	if c.Config != nil {
+		node.commitConfig(*c.Config)
+	}
+	node.completeReconfigs()
 	node.commitCounter++
+	node.maybeSnapshot()
 
 	// trainPath := "./data/mnist_png/mnist_png_training_shuffled.tar.gz"
 	// testPath := "./data/mnist_png/mnist_png_testing_shuffled.tar.gz"
@@ -342,63 +694,137 @@ func (node *ZabNode) commit(c *ZabProposalAckCommit) {
 }
 
 // Heartbeat
-func (node *ZabNode) heartbeat() {
-	for i, _ := range node.heartbeats {
-		node.heartbeats[i] = time.Now()
+func (node *ZabNode) startHeartbeat() {
+	now := node.clock.Now()
+	for _, id := range node.members() {
+		node.detector.Reset(id, now)
 	}
-	for {
-		if node.id != node.leaderId {
-			node.heartbeatNet.Send(node.leaderId, node.id)
-			util.Logger.Println("sent heartbeat to leader at", time.Now())
-			if time.Time.Sub(time.Now(), node.heartbeats[node.leaderId]) >= node.timeout {
-				// go to phase 0
-				// panic("follower didn't receive heartbeat")
-				node.reset = true
-				return
-			}
-		} else {
-			node.heartbeatNet.Broadcast(node.id)
-			util.Logger.Println("sent heartbeat to followers at", time.Now())
-			count := 0
-			for nodeId, t := range node.heartbeats {
-				if time.Time.Sub(time.Now(), t) < node.timeout {
-					count++
-				} else {
-					util.Logger.Println("leader received stale heartbeat from node", nodeId, "at time", time.Now())
-				}
+	node.leaseGrants = make(map[int]time.Time)
+	node.heartbeating = true
+	node.nextHeartbeat = now
+}
+
+// stopHeartbeat ends heartbeating without a reset
+func (node *ZabNode) stopHeartbeat() {
+	node.heartbeating = false
+}
+
+// heartbeatTick runs a round every heartbeatPeriod until one decides to
+//   reset. It runs from Run, so heartbeats never race with the protocol.
+func (node *ZabNode) heartbeatTick() {
+	now := node.clock.Now()
+	if !node.heartbeating || now.Before(node.nextHeartbeat) {
+		return
+	}
+	node.nextHeartbeat = now.Add(node.heartbeatPeriod)
+	if !node.heartbeatRound() {
+		node.heartbeating = false
+	}
+}
+
+func (node *ZabNode) heartbeatRound() bool {
+	if node.removed {
+		return false
+	}
+	now := node.clock.Now()
+	if node.id != node.leaderId {
+		node.heartbeatNet.Send(node.leaderId, node.heartbeatMessage())
+		util.Logger.Println("sent heartbeat to leader at", now)
+		if !node.detector.IsAvailable(node.leaderId, now) {
+			fmt.Println("suspecting leader", node.leaderId, "with suspicion", node.detector.Suspicion(node.leaderId, now))
+			// go to phase 0
+			// panic("follower didn't receive heartbeat")
+			node.reset = true
+			return false
+		}
+	} else {
+		node.heartbeatNet.Broadcast(node.heartbeatMessage())
+		util.Logger.Println("sent heartbeat to followers at", now)
+		alive := []int{node.id}
+		for _, nodeId := range node.voters() {
+			if nodeId == node.id {
+				continue
 			}
-			if count <= node.numNodes/2 {
-				// go to phase 0
-				fmt.Println("leader didn't receive enough heartbeats")
-				node.reset = true
-				return
+			if node.detector.IsAvailable(nodeId, now) {
+				alive = append(alive, nodeId)
+			} else {
+				util.Logger.Println("leader suspects node", nodeId, "with suspicion", node.detector.Suspicion(nodeId, now), "at time", now)
 			}
 		}
-
-		sender, received := node.heartbeatNet.Receive()
-		for received {
-			node.handleHeartbeat(sender)
-			sender, received = node.heartbeatNet.Receive()
+		if !node.isQuorum(alive) {
+			// go to phase 0
+			fmt.Println("leader didn't receive enough heartbeats")
+			node.reset = true
+			return false
 		}
+	}
 
-		time.Sleep(100 * time.Millisecond)
+	hb, received := node.heartbeatNet.Receive()
+	for received {
+		node.handleHeartbeat(hb)
+		hb, received = node.heartbeatNet.Receive()
 	}
+	return !node.reset
 }
 
-func (node *ZabNode) handleHeartbeat(sender int) {
+// handleHeartbeat fences off leaders of old epochs: a follower only takes
+//   heartbeats from its leader in the current epoch and answers a stale
+//   leader with its own epoch, and a leader that hears of a newer epoch
+//   steps down
+func (node *ZabNode) handleHeartbeat(hb ZabHeartbeat) {
+	t := node.clock.Now()
+	if hb.Epoch > node.currentEpoch {
+		if node.id == node.leaderId {
+			fmt.Println("leader of epoch", node.currentEpoch, "stepping down, node", hb.SenderId, "is in epoch", hb.Epoch)
+		} else {
+			fmt.Println("leader", node.leaderId, "of epoch", node.currentEpoch, "was superseded, node", hb.SenderId, "is in epoch", hb.Epoch)
+		}
+		node.reset = true
+		return
+	}
+	if hb.Epoch < node.currentEpoch {
+		util.Logger.Println("rejecting heartbeat from", hb.SenderId, "of stale epoch", hb.Epoch)
+		if hb.LeaderId == hb.SenderId {
+			node.heartbeatNet.Send(hb.SenderId, node.heartbeatMessage())
+		}
+		return
+	}
 	if node.id != node.leaderId {
-		if sender == node.leaderId {
-			node.heartbeats[node.leaderId] = time.Now()
-			util.Logger.Println("received heartbeat at", time.Now())
+		if hb.SenderId == node.leaderId && hb.LeaderId == node.leaderId {
+			node.detector.Heartbeat(hb.SenderId, t)
+			if hb.LastCommitted.after(node.leaderCommitted) {
+				if !node.behindLeader() {
+					node.commitGapSince = t
+				}
+				node.leaderCommitted = hb.LastCommitted
+			}
+			node.leaderLease = hb.LeaseExpiry
+			node.leaseHolder = hb.SenderId
+			util.Logger.Println("received heartbeat at", t, "leader committed", hb.LastCommitted)
 		} else {
 			util.Logger.Println("follower got heartbeat from non-leader")
 		}
-	} else {
-		t := time.Now()
-		node.heartbeats[sender] = t
-		util.Logger.Println("received heartbeat from", sender, "at", t)
+	} else if hb.LeaderId == node.id {
+		node.detector.Heartbeat(hb.SenderId, t)
+		node.recordLeaseGrant(hb)
+		util.Logger.Println("received heartbeat from", hb.SenderId, "at", t)
+	}
+}
 
+// heartbeatMessage describes who we think leads which epoch. Followers
+//   echo the lease of the last leader heartbeat they took.
+func (node *ZabNode) heartbeatMessage() ZabHeartbeat {
+	hb := ZabHeartbeat{
+		SenderId:      node.id,
+		Epoch:         node.currentEpoch,
+		LeaderId:      node.leaderId,
+		LastCommitted: node.lastCommitted,
+		LeaseExpiry:   node.leaderLease,
+	}
+	if node.id == node.leaderId {
+		hb.LeaseExpiry = node.clock.Now().Add(node.leaseDuration)
 	}
+	return hb
 }
 
 /****************************************************************************************************/
@@ -407,14 +833,23 @@ func (node *ZabNode) handleHeartbeat(sender int) {
 
 // Phase 1
 func (node *ZabNode) handleFollowerInfo(msg *ZabMessage) {
-	// may need to handle this in phase 3 as well
-	if len(node.followerInfos) > node.numNodes/2 {
+	// Followers that show up after the new epoch went out keep retrying,
+	//   and are brought in by handleIncomingFollower once we reach phase 3
+	if node.newEpochProposed {
+		return
+	}
+	if !node.isMember(msg.SenderId) {
+		util.Logger.Println("ignoring follower", msg.SenderId, "that is not in the config")
 		return
 	}
 	node.followerInfos[msg.SenderId] = msg.Epoch
 	fmt.Println("length of followerinfos:", len(node.followerInfos))
-	if len(node.followerInfos) == node.numNodes/2 {
-		maxEpoch := 0
+	if node.isQuorum(append(sortedKeys(node.followerInfos), node.id)) {
+		if node.promisedElsewhere(node.id) {
+			util.Logger.Println("not proposing a new epoch before the lease we granted", node.leaseHolder, "runs out")
+			return
+		}
+		maxEpoch := node.acceptedEpoch
 		for _, epoch := range node.followerInfos {
 			if epoch > maxEpoch {
 				maxEpoch = epoch
@@ -422,7 +857,7 @@ func (node *ZabNode) handleFollowerInfo(msg *ZabMessage) {
 		}
 		fmt.Println("maxepoch", maxEpoch)
 		newEpoch := maxEpoch + 1
-		for nodeId, _ := range node.followerInfos {
+		for _, nodeId := range sortedKeys(node.followerInfos) {
 			err := node.SendHelper(nodeId, ZabMessage{
 				SenderId: node.id,
 				Epoch:    newEpoch,
@@ -434,41 +869,42 @@ func (node *ZabNode) handleFollowerInfo(msg *ZabMessage) {
 			fmt.Println("sent to", nodeId)
 		}
 		node.leaderId = node.id
+		node.newEpochProposed = true
 		node.phase = 1
 	}
 }
 
 func (node *ZabNode) handleAckEpoch(msg *ZabMessage) {
 	fmt.Println("in handleAckEpoch")
-	node.followerAckEpochs[msg.SenderId] = &msg.ZabViewChange
+	// msg is the receive buffer, which the next message overwrites
+	view := msg.ZabViewChange
+	node.followerAckEpochs[msg.SenderId] = &view
 
 	if len(node.followerAckEpochs) == len(node.followerInfos) {
-		maxCurrEpoch := -1
-		maxEpoch := -1
-		maxCounter := -1
-		maxNodeId := -1
-		for nodeId, followerAckEpoch := range node.followerAckEpochs {
-			ce := followerAckEpoch.CurrentEpoch
-			e := followerAckEpoch.LastZxid.Epoch
-			c := followerAckEpoch.LastZxid.Counter
-			if ce > maxCurrEpoch || (ce == maxCurrEpoch && e > maxEpoch) || (ce == maxCurrEpoch && e == maxEpoch && c > maxCounter) {
-				maxCurrEpoch = ce
-				maxEpoch = e
-				maxCounter = c
-				maxNodeId = nodeId
+		// election picked us for having the most up to date history, but
+		//   if a follower is ahead after all we could lose its commits
+		leaderEpoch, leaderCounter := node.getLastZxid()
+		leaderVote := ZabVote{LeaderId: node.id, CurrentEpoch: node.currentEpoch, LastZxid: ZabZxid{leaderEpoch, leaderCounter}}
+		for _, nodeId := range sortedKeys(node.followerAckEpochs) {
+			followerAckEpoch := node.followerAckEpochs[nodeId]
+			followerVote := ZabVote{LeaderId: -1, CurrentEpoch: followerAckEpoch.CurrentEpoch, LastZxid: followerAckEpoch.LastZxid}
+			if followerVote.better(leaderVote) {
+				fmt.Println("follower", nodeId, "is ahead of us, going back to election")
+				node.reset = true
+				return
 			}
 		}
-		node.history = node.followerAckEpochs[maxNodeId].History
 		node.phase = 2
-		for nodeId, _ := range node.followerInfos {
+		for _, nodeId := range sortedKeys(node.followerInfos) {
 			fmt.Println("sending new leader to", nodeId)
+			// all of our history is committed once the epoch starts
+			view := node.syncFor(node.followerAckEpochs[nodeId].LastZxid)
+			view.LastZxid = leaderVote.LastZxid
 			node.SendHelper(nodeId, ZabMessage{
-				SenderId: node.id,
-				Epoch:    msg.Epoch,
-				MsgType:  NEWLEADER,
-				ZabViewChange: ZabViewChange{
-					History: node.history,
-				},
+				SenderId:      node.id,
+				Epoch:         msg.Epoch,
+				MsgType:       NEWLEADER,
+				ZabViewChange: view,
 			})
 		}
 		node.followerInfos = make(map[int]int)
@@ -481,19 +917,27 @@ func (node *ZabNode) handleAckEpoch(msg *ZabMessage) {
 
 // Phase 2
 func (node *ZabNode) handleAckNewLeader(msg *ZabMessage) {
-	if len(node.followerAckNewLeaders) > node.numNodes/2 {
+	if node.isObserver(msg.SenderId) {
 		return
 	}
 	node.followerAckNewLeaders[msg.SenderId] = true
-	if len(node.followerAckNewLeaders) == node.numNodes/2 {
-		node.net.BroadcastToRest(ZabMessage{
+	if node.isQuorum(append(sortedKeys(node.followerAckNewLeaders), node.id)) {
+		node.broadcastToVoters(ZabMessage{
 			SenderId: node.id,
 			MsgType:  COMMITNEWLEADER,
 		})
 		// Go to phase 3
 		node.phase = 3
+		node.commitHistory()
+		node.startProposing()
+		node.resendWrites()
+		node.flushPending()
+		if err := node.storage.SaveEpochs(msg.CurrentEpoch, msg.CurrentEpoch); err != nil {
+			util.Logger.Println("failed to persist new epoch:", err)
+		}
+		node.acceptedEpoch = msg.CurrentEpoch
 		node.currentEpoch = msg.CurrentEpoch
-		go node.heartbeat()
+		node.startHeartbeat()
 		node.followerAckEpochs = make(map[int]*ZabViewChange)
 		fmt.Println("Entering phase 3")
 	} else {
@@ -503,51 +947,47 @@ func (node *ZabNode) handleAckNewLeader(msg *ZabMessage) {
 
 // Phase 3
 func (node *ZabNode) handleWriteRequest(msg *ZabProposalAckCommit) {
-	// propose to all followers in Q
-	msg.Counter = node.leaderCounter
-	msg.Epoch = node.currentEpoch
-	node.leaderCounter += 1
-	util.Logger.Println("broadcasting with counter", msg.Counter)
-	node.net.BroadcastToRest(ZabMessage{
-		SenderId:             node.id,
-		MsgType:              PROPOSAL,
-		ZabProposalAckCommit: *msg,
-	})
-	node.ackCounter = append(node.ackCounter, 0)
-}
-
-func (node *ZabNode) handleAck(msg *ZabProposalAckCommit) {
-	if node.ackCounter[msg.Counter] > node.numNodes/2 {
+	if node.transferTarget != -1 {
+		util.Logger.Println("dropping write", msg.Write.Seq, "from", msg.Write.Session.NodeId, "during leadership transfer")
 		return
 	}
-	// increment counter for this message
-	util.Logger.Println("counter is", msg.Counter)
-	node.ackCounter[msg.Counter] += 1
-	// if we have a quorum, send commit
-	if node.ackCounter[msg.Counter] == node.numNodes/2 {
-		node.net.BroadcastToRest(ZabMessage{
-			SenderId:             node.id,
-			MsgType:              COMMIT,
-			ZabProposalAckCommit: *msg,
-		})
-		node.commit(msg)
+	// propose to all followers in Q, batched with other requests
+	node.acceptWrite(msg.Write)
+}
+
+func (node *ZabNode) handleAck(msg *ZabMessage) {
+	for i := range node.inFlight {
+		if node.inFlight[i].zxid == msg.zxid() {
+			// a set, so duplicated acks are only counted once
+			node.inFlight[i].acks[msg.SenderId] = true
+			util.Logger.Println("ack from", msg.SenderId, "for counter", msg.Counter)
+			break
+		}
 	}
+	// if the front of the pipeline has a quorum, send commits
+	node.commitAcked()
 }
 
 func (node *ZabNode) handleIncomingFollower(msg *ZabMessage) {
 	if node.id == node.leaderId {
+		if !node.isMember(msg.SenderId) {
+			util.Logger.Println("ignoring follower", msg.SenderId, "that is not in the config")
+			return
+		}
 		node.SendHelper(msg.SenderId, ZabMessage{
 			SenderId: node.id,
 			MsgType:  NEWEPOCH,
 			Epoch:    node.currentEpoch,
 		})
+		// the follower commits only what we have committed, and acks the
+		//   proposals still in flight
+		view := node.syncFor(msg.LastZxid)
+		view.LastZxid = node.lastCommitted
 		node.SendHelper(msg.SenderId, ZabMessage{
-			SenderId: node.id,
-			MsgType:  NEWLEADER,
-			Epoch:    node.currentEpoch,
-			ZabViewChange: ZabViewChange{
-				History: node.history,
-			},
+			SenderId:      node.id,
+			MsgType:       NEWLEADER,
+			Epoch:         node.currentEpoch,
+			ZabViewChange: view,
 		})
 	} else {
 		node.handleFollowerInfo(msg)
@@ -578,14 +1018,14 @@ func (node *ZabNode) getFromPendingCommit(epoch int, counter int) (*ZabProposalA
 }
 
 func (node *ZabNode) SendHelper(receivingNodeId int, msg ZabMessage) error {
-	util.Logger.Printf("Sending from %d to %d of type %s at time %s\n", node.id, receivingNodeId, msg.MsgType, time.Now())
+	util.Logger.Printf("Sending from %d to %d of type %s at time %s\n", node.id, receivingNodeId, msg.MsgType, node.clock.Now())
 	return node.net.Send(receivingNodeId, msg)
 }
 
-func (node *ZabNode) ReceiveHelper() (ZabMessage, bool) {
-	msg, received := node.net.Receive()
+func (node *ZabNode) ReceiveHelper(timeout time.Duration) (ZabMessage, bool) {
+	msg, received := node.net.ReceiveTimeout(timeout)
 	if received {
-		util.Logger.Printf("Receiving from %d of type %s at time %s\n", msg.SenderId, msg.MsgType, time.Now())
+		util.Logger.Printf("Receiving from %d of type %s at time %s\n", msg.SenderId, msg.MsgType, node.clock.Now())
 	}
 	return msg, received
 }
@@ -601,6 +1041,10 @@ func (node *ZabNode) setFromPendingCommit(epoch int, counter int, val *ZabPropos
 func (node *ZabNode) getLastZxid() (int, int) {
 	maxEpoch := -1
 	maxCounter := -1
+	if node.snapshot != nil {
+		maxEpoch = node.snapshot.Zxid.Epoch
+		maxCounter = node.snapshot.Zxid.Counter
+	}
 	for _, val := range node.history {
 		if val.Epoch > maxEpoch || (val.Epoch == maxEpoch && val.Counter > maxCounter) {
 			maxEpoch = val.Epoch
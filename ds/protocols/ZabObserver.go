@@ -0,0 +1,268 @@
+package protocols
+
+import (
+	"flads/util"
+	"fmt"
+)
+
+// Observers follow the committed gradient stream without being part of
+//   the ensemble: they never vote, never ack and are never counted in a
+//   quorum, so they can come and go without affecting liveness. Every node
+//   is told which ids are observers with SetObservers, after that they
+//   change through reconfiguration.
+//
+//   An observer keeps sending OBSERVERINFO to the voters until the leader
+//   answers with a NEWLEADER that syncs it up to the last commit. From then
+//   on the leader sends it an INFORM with the full proposal for every
+//   commit. INFORMs that arrive ahead of a missing one are held back; if
+//   the gap does not fill within electionTimeout the observer asks for a
+//   resync, and if the leader's heartbeats stop it goes back to looking
+//   for a leader.
+//
+//   Observers can submit writes like any other node. They are sent to the
+//   leader once the observer is synced, and resent like a follower's.
+
+// SetObservers marks ids as observers. Must be called with the same ids on
+//   every node, before Run.
+func (node *ZabNode) SetObservers(ids []int) {
+	members := make(map[int]ZabMember)
+	for id, member := range node.config.Members {
+		member.Observer = false
+		members[id] = member
+	}
+	for _, id := range ids {
+		member := members[id]
+		member.Observer = true
+		members[id] = member
+	}
+	node.config.Members = members
+}
+
+func (node *ZabNode) isObserver(id int) bool {
+	member, ok := node.config.Members[id]
+	return ok && member.Observer
+}
+
+// voters returns the ids that take part in elections and quorums, in any
+//   of the configs we may be in
+func (node *ZabNode) voters() []int {
+	voters := make(map[int]bool)
+	for _, config := range node.configs() {
+		for _, id := range config.voters() {
+			voters[id] = true
+		}
+	}
+	return sortedKeys(voters)
+}
+
+// broadcastToVoters is BroadcastToRest without the observers
+func (node *ZabNode) broadcastToVoters(msg ZabMessage) error {
+	var lastErr error
+	for _, id := range node.voters() {
+		if id == node.id {
+			continue
+		}
+		if err := node.SendHelper(id, msg); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+/****************************************************************************************************/
+/***************************************Observer*****************************************************/
+/****************************************************************************************************/
+
+func (node *ZabNode) runObserver() {
+	if node.reset {
+		fmt.Println("observer looking for a leader")
+		node.reset = false
+		node.phase = 0
+		node.leaderId = -1
+		node.stopHeartbeat()
+		node.pendingInforms = make(map[ZabZxid]ZabProposalAckCommit)
+		node.sendObserverInfo(-1)
+	} else if node.phase == 0 && node.clock.Now().Sub(node.lastFollowerInfoSent) >= node.electionTimeout {
+		node.sendObserverInfo(-1)
+	}
+	node.heartbeatTick()
+	if node.phase == 3 {
+		node.writeTick()
+	}
+	node.syncTick()
+
+	zabMsg, received := node.ReceiveHelper(node.receiveTimeout)
+	for received && !node.reset {
+		switch zabMsg.MsgType {
+		case NEWLEADER:
+			node.handleObserverSync(&zabMsg)
+		case INFORM:
+			node.handleInform(&zabMsg)
+		case STEPDOWN:
+			node.handleStepDown(&zabMsg)
+		case SYNCREPLY:
+			node.handleSyncReply(&zabMsg)
+		}
+		zabMsg, received = node.ReceiveHelper(0)
+	}
+}
+
+// sendObserverInfo asks the leader to sync us, or anyone who is leading
+//   if leaderId is -1
+func (node *ZabNode) sendObserverInfo(leaderId int) {
+	node.lastFollowerInfoSent = node.clock.Now()
+	epoch, counter := node.getLastZxid()
+	msg := ZabMessage{
+		SenderId: node.id,
+		MsgType:  OBSERVERINFO,
+		ZabViewChange: ZabViewChange{
+			LastZxid: ZabZxid{epoch, counter},
+		},
+	}
+	if leaderId == -1 {
+		node.broadcastToVoters(msg)
+	} else {
+		node.SendHelper(leaderId, msg)
+	}
+}
+
+func (node *ZabNode) handleObserverSync(msg *ZabMessage) {
+	if node.phase == 3 && msg.SenderId != node.leaderId {
+		return
+	}
+	if err := node.applySync(&msg.ZabViewChange); err != nil {
+		util.Logger.Println("observer failed to sync:", err)
+		return
+	}
+	// the leader only sends us committed proposals
+	node.commitHistory()
+	node.applyPendingInforms()
+	if node.phase != 3 {
+		fmt.Println("observing leader", msg.SenderId)
+		node.leaderId = msg.SenderId
+		// observers take no part in epochs, but heartbeats are checked
+		//   against the leader's
+		node.currentEpoch = msg.Epoch
+		node.phase = 3
+		node.startHeartbeat()
+		// observers write too, and anything submitted while we were
+		//   looking for a leader went nowhere
+		node.resendWrites()
+	}
+}
+
+func (node *ZabNode) handleInform(msg *ZabMessage) {
+	if node.phase != 3 || msg.SenderId != node.leaderId {
+		return
+	}
+	if !msg.zxid().after(node.lastCommitted) {
+		// duplicate
+		return
+	}
+	if len(node.pendingInforms) == 0 {
+		node.informGapSince = node.clock.Now()
+	}
+	node.pendingInforms[msg.LastZxid] = msg.ZabProposalAckCommit
+	node.applyPendingInforms()
+
+	now := node.clock.Now()
+	if len(node.pendingInforms) > 0 && now.Sub(node.informGapSince) >= node.electionTimeout &&
+		now.Sub(node.lastFollowerInfoSent) >= node.electionTimeout {
+		fmt.Println("observer missed a commit, resyncing")
+		node.sendObserverInfo(node.leaderId)
+	}
+}
+
+// applyPendingInforms commits held back INFORMs for as long as they
+//   follow on from our last commit
+func (node *ZabNode) applyPendingInforms() {
+	for {
+		proposal, ok := node.pendingInforms[node.lastCommitted]
+		if !ok {
+			break
+		}
+		delete(node.pendingInforms, node.lastCommitted)
+		if err := node.storage.AppendProposal(proposal); err != nil {
+			util.Logger.Println("observer failed to persist proposal:", err)
+			return
+		}
+		node.insertProposal(proposal)
+		node.commitThrough(proposal.zxid())
+	}
+	// anything left that we already have came in through a resync
+	for prev, proposal := range node.pendingInforms {
+		if !proposal.zxid().after(node.lastCommitted) {
+			delete(node.pendingInforms, prev)
+		}
+	}
+	if len(node.pendingInforms) > 0 {
+		return
+	}
+	node.informGapSince = node.clock.Now()
+}
+
+/****************************************************************************************************/
+/***************************************Leader*******************************************************/
+/****************************************************************************************************/
+
+// handleObserverInfo attaches an observer, or resyncs one that fell behind
+func (node *ZabNode) handleObserverInfo(msg *ZabMessage) {
+	if node.leaderId != node.id || !node.isObserver(msg.SenderId) {
+		return
+	}
+	if !node.observing[msg.SenderId] {
+		fmt.Println("observer", msg.SenderId, "attached")
+	}
+	node.observing[msg.SenderId] = true
+	node.detector.Heartbeat(msg.SenderId, node.clock.Now())
+
+	// unlike a follower, an observer only ever gets committed proposals
+	view := node.syncFor(msg.LastZxid)
+	committed := make([]ZabProposalAckCommit, 0, len(view.History))
+	for _, proposal := range view.History {
+		if !proposal.zxid().after(node.lastCommitted) {
+			committed = append(committed, proposal)
+		}
+	}
+	view.History = committed
+	node.SendHelper(msg.SenderId, ZabMessage{
+		SenderId:      node.id,
+		Epoch:         node.currentEpoch,
+		MsgType:       NEWLEADER,
+		ZabViewChange: view,
+	})
+}
+
+// informObservers sends a proposal that is about to be committed to every
+//   attached observer, along with the commit before it so gaps show up
+func (node *ZabNode) informObservers(zxid ZabZxid) {
+	if len(node.observing) == 0 {
+		return
+	}
+	proposal := node.proposalAt(zxid)
+	if proposal == nil {
+		return
+	}
+	for _, id := range sortedKeys(node.observing) {
+		node.SendHelper(id, ZabMessage{
+			SenderId:             node.id,
+			Epoch:                node.currentEpoch,
+			MsgType:              INFORM,
+			ZabProposalAckCommit: *proposal,
+			ZabViewChange: ZabViewChange{
+				LastZxid: node.lastCommitted,
+			},
+		})
+	}
+}
+
+// pruneObservers detaches observers whose heartbeats stopped
+func (node *ZabNode) pruneObservers() {
+	now := node.clock.Now()
+	for _, id := range sortedKeys(node.observing) {
+		if !node.detector.IsAvailable(id, now) {
+			fmt.Println("observer", id, "detached")
+			delete(node.observing, id)
+		}
+	}
+}
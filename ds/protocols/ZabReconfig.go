@@ -0,0 +1,243 @@
+package protocols
+
+import (
+	"flads/util"
+	"fmt"
+)
+
+// Reconfiguration, modelled on ZooKeeper's dynamic reconfig. The members
+//   of the ensemble are a ZabConfig that is replicated like everything
+//   else: Reconfigure sends a write asking for nodes to be added or
+//   removed, and the leader turns it into a proposal that carries the new
+//   config. From the moment that proposal is in a node's history until it
+//   commits, the node needs a quorum of the old config and a quorum of the
+//   new one for everything (as in Raft's joint consensus), so the two can
+//   never make progress separately. Once it commits the new config is in
+//   effect and the network tables are updated with its addresses.
+//
+//   The leader only syncs nodes that are in one of its configs, so a new
+//   node keeps retrying until it has been added. A node that is removed
+//   while it follows or leads stops taking part, the rest elect a new
+//   leader among themselves if need be.
+
+type ZabMember struct {
+	// empty addresses leave the network tables as they are
+	Address          string
+	HeartbeatAddress string
+	Observer         bool
+	// hierarchical quorums, Group 0 means the config uses plain majorities
+	Group  int
+	Weight int
+}
+
+type ZabConfig struct {
+	Version int
+	Members map[int]ZabMember
+}
+
+type ZabReconfig struct {
+	Add    map[int]ZabMember
+	Remove []int
+}
+
+// ZabReconfigResult is filled in once the reconfiguration has committed.
+//   Config is the config in effect after it, which is unchanged if the
+//   leader rejected the change.
+type ZabReconfigResult struct {
+	Done   bool
+	Config ZabConfig
+}
+
+func initialZabConfig(numNodes int) ZabConfig {
+	members := make(map[int]ZabMember)
+	for id := 0; id < numNodes; id++ {
+		members[id] = ZabMember{}
+	}
+	return ZabConfig{Members: members}
+}
+
+func (config ZabConfig) voters() []int {
+	voters := make([]int, 0, len(config.Members))
+	for _, id := range sortedKeys(config.Members) {
+		if !config.Members[id].Observer {
+			voters = append(voters, id)
+		}
+	}
+	return voters
+}
+
+// isQuorum reports whether nodeIds include a quorum of the voters of
+//   config
+func (config ZabConfig) isQuorum(nodeIds []int) bool {
+	return config.verifier().ContainsQuorum(nodeIds)
+}
+
+// with returns config with reconfig applied, or an error if the result
+//   cannot make a quorum
+func (config ZabConfig) with(reconfig ZabReconfig) (ZabConfig, error) {
+	members := make(map[int]ZabMember, len(config.Members))
+	for id, member := range config.Members {
+		members[id] = member
+	}
+	for _, id := range reconfig.Remove {
+		delete(members, id)
+	}
+	for id, member := range reconfig.Add {
+		members[id] = member
+	}
+	next := ZabConfig{config.Version + 1, members}
+	return next, next.validate()
+}
+
+// SetConfig sets the config a node starts from when the ensemble is not
+//   just the ids below numNodes. Must be called with the same config on
+//   every node, before SetObservers, SetStorage and Run.
+func (node *ZabNode) SetConfig(config ZabConfig) {
+	node.config = config
+}
+
+// Config returns the config in effect on this node
+func (node *ZabNode) Config() ZabConfig {
+	return node.config
+}
+
+// Reconfigure asks the leader to add and remove members. Adding a member
+//   that exists already changes its addresses or role. Like any other
+//   write it is resent until it commits.
+func (node *ZabNode) Reconfigure(add map[int]ZabMember, remove []int) *ZabReconfigResult {
+	result := &ZabReconfigResult{}
+	write := node.newWrite(nil, &ZabReconfig{add, remove})
+	node.reconfigs[write.Seq] = result
+	node.submitWrite(write)
+	return result
+}
+
+// configs returns the committed config followed by every config proposed
+//   after it
+func (node *ZabNode) configs() []ZabConfig {
+	configs := []ZabConfig{node.config}
+	for _, proposal := range node.history {
+		if proposal.Config != nil && proposal.zxid().after(node.lastCommitted) {
+			configs = append(configs, *proposal.Config)
+		}
+	}
+	return configs
+}
+
+// isQuorum reports whether nodeIds include a quorum of every config we may
+//   be in
+func (node *ZabNode) isQuorum(nodeIds []int) bool {
+	for _, config := range node.configs() {
+		if !config.isQuorum(nodeIds) {
+			return false
+		}
+	}
+	return true
+}
+
+func (node *ZabNode) isMember(id int) bool {
+	for _, config := range node.configs() {
+		if _, ok := config.Members[id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (node *ZabNode) isVoter(id int) bool {
+	for _, config := range node.configs() {
+		if member, ok := config.Members[id]; ok && !member.Observer {
+			return true
+		}
+	}
+	return false
+}
+
+// members returns every id in any of our configs, observers included
+func (node *ZabNode) members() []int {
+	ids := make(map[int]bool)
+	for _, config := range node.configs() {
+		for id := range config.Members {
+			ids[id] = true
+		}
+	}
+	return sortedKeys(ids)
+}
+
+// proposedConfig applies the reconfigurations in batch on top of the
+//   newest config, or returns nil if there are none
+func (node *ZabNode) proposedConfig(batch []ZabWrite) *ZabConfig {
+	configs := node.configs()
+	config := configs[len(configs)-1]
+	changed := false
+	for _, write := range batch {
+		if write.Reconfig == nil {
+			continue
+		}
+		next, err := config.with(*write.Reconfig)
+		if err != nil {
+			fmt.Println("rejecting a reconfiguration from", write.Session.NodeId, "because", err)
+			continue
+		}
+		config = next
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return &config
+}
+
+// commitConfig puts a committed config into effect
+func (node *ZabNode) commitConfig(config ZabConfig) {
+	_, wasMember := node.config.Members[node.id]
+	node.applyConfig(config)
+	// during a sync we replay old configs, only a live removal counts
+	if _, member := config.Members[node.id]; wasMember && !member && node.phase == 3 {
+		fmt.Println("node", node.id, "was removed from the ensemble")
+		node.removed = true
+	}
+}
+
+func (node *ZabNode) applyConfig(config ZabConfig) {
+	old := node.config
+	node.config = config
+	now := node.clock.Now()
+	for _, id := range sortedKeys(config.Members) {
+		member := config.Members[id]
+		if member.Address != "" {
+			node.net.SetNodeAddress(id, member.Address)
+		}
+		if member.HeartbeatAddress != "" {
+			node.heartbeatNet.SetNodeAddress(id, member.HeartbeatAddress)
+		}
+		// new members get a full timeout before the leader counts them out
+		if _, ok := old.Members[id]; !ok {
+			node.detector.Reset(id, now)
+		}
+	}
+	for _, id := range sortedKeys(old.Members) {
+		if _, ok := config.Members[id]; ok || id == node.id {
+			continue
+		}
+		node.net.RemoveNode(id)
+		node.heartbeatNet.RemoveNode(id)
+		node.detector.Remove(id)
+		delete(node.observing, id)
+	}
+	util.Logger.Println("config", config.Version, "in effect with members", sortedKeys(config.Members))
+}
+
+// completeReconfigs fills in the results of our reconfigurations that
+//   have committed
+func (node *ZabNode) completeReconfigs() {
+	for _, seq := range sortedKeys(node.reconfigs) {
+		if seq > node.sessions[node.session] {
+			break
+		}
+		result := node.reconfigs[seq]
+		result.Config = node.config
+		result.Done = true
+		delete(node.reconfigs, seq)
+	}
+}
@@ -0,0 +1,96 @@
+package protocols
+
+import (
+	"flads/ml"
+	"flads/util"
+	"fmt"
+)
+
+// Training does not stop while the ensemble is electing a leader or
+//   syncing, so gradients produced outside of phase 3 are kept in a queue
+//   of at most maxPending entries and sent to the new leader once we reach
+//   phase 3. The policy decides what happens when the queue is full.
+
+type ZabRecoveryPolicy string
+
+const (
+	// ACCUMULATE sums everything queued into one update, so every
+	//   gradient is still applied
+	ACCUMULATE = "accumulate"
+	// AVERAGE replaces everything queued with its average
+	AVERAGE = "average"
+	// DROP_OLDEST throws the oldest gradient away
+	DROP_OLDEST = "drop-oldest"
+	// PAUSE stops taking gradients, and TrainingPaused tells the caller to
+	//   stop training until we are back in phase 3
+	PAUSE = "pause"
+)
+
+func (node *ZabNode) SetRecoveryPolicy(policy ZabRecoveryPolicy, maxPending int) {
+	node.recoveryPolicy = policy
+	node.maxPending = maxPending
+}
+
+// TrainingPaused reports whether the caller should hold off on training
+//   because the recovery queue is full under the PAUSE policy
+func (node *ZabNode) TrainingPaused() bool {
+	return node.recoveryPolicy == PAUSE && node.phase != 3 && len(node.pending) >= node.maxPending
+}
+
+// submitLocalGradients sends the gradients of our model once they are
+//   ready, in phase 3
+func (node *ZabNode) submitLocalGradients() {
+	if node.ml == nil {
+		return
+	}
+	if ready, localGrads := node.ml.GetGradients(); ready {
+		node.submitGradients(localGrads)
+		util.Logger.Println("From ZabNode Run(): sent grads to leader from", node.id)
+	}
+}
+
+func (node *ZabNode) submitGradients(grads ml.Gradients) {
+	command, err := EncodeGradients(grads)
+	if err != nil {
+		util.Logger.Println("failed to encode gradients:", err)
+		return
+	}
+	node.submitTo(zabModel)(command)
+}
+
+// queueLocalGradients runs outside of phase 3 in place of sending writes
+func (node *ZabNode) queueLocalGradients() {
+	if node.ml == nil || node.TrainingPaused() {
+		return
+	}
+	ready, localGrads := node.ml.GetGradients()
+	if !ready {
+		return
+	}
+
+	node.pending = append(node.pending, localGrads)
+	if len(node.pending) <= node.maxPending {
+		return
+	}
+	switch node.recoveryPolicy {
+	case ACCUMULATE:
+		node.pending = []ml.Gradients{ml.MergeGradients(node.pending)}
+	case AVERAGE:
+		node.pending = []ml.Gradients{ml.AverageGradients(node.pending)}
+	default:
+		// DROP_OLDEST, and PAUSE only gets here if maxPending is 0
+		node.pending = node.pending[1:]
+	}
+}
+
+// flushPending sends the queue to the leader as ordinary writes
+func (node *ZabNode) flushPending() {
+	if len(node.pending) == 0 {
+		return
+	}
+	fmt.Println("flushing", len(node.pending), "gradients queued during recovery to", node.leaderId)
+	for _, grads := range node.pending {
+		node.submitGradients(grads)
+	}
+	node.pending = nil
+}
@@ -0,0 +1,215 @@
+package protocols
+
+import (
+	"flads/util"
+	"fmt"
+	"time"
+)
+
+// Writes are idempotent. Every node numbers its write requests within a
+//   session, and the leader only proposes the next sequence number of a
+//   session, so a write that is resent after a leader change or duplicated
+//   by the network is dropped instead of being applied twice. The highest
+//   committed sequence number of every session is part of the replicated
+//   state: it is updated as proposals commit and saved in snapshots, so a
+//   new leader knows what the old one committed.
+//
+//   A node keeps its writes until they commit, resends them all to every
+//   new leader, and resends them to the current leader if nothing commits
+//   for writeRetryTimeout.
+//
+//   A restarted node starts a new session, and the first commit from it
+//   drops the sessions of its earlier runs. Writes from those runs that
+//   are still in flight are dropped from then on, so the table only holds
+//   one session per node.
+
+// ZabSession identifies one run of a node, Start tells restarts apart
+type ZabSession struct {
+	NodeId int
+	Start  int64
+}
+
+// Command is opaque to Zab, it is handed to the state machine as is.
+//   A write with a Reconfig changes the members instead.
+type ZabWrite struct {
+	Session  ZabSession
+	Seq      int
+	Command  []byte
+	Reconfig *ZabReconfig
+}
+
+/****************************************************************************************************/
+/***************************************Follower*****************************************************/
+/****************************************************************************************************/
+
+// Submit asks the ensemble to apply command. It is sent to the leader right
+//   away in phase 3, and otherwise to whoever leads next. command goes to
+//   the state machine as is, so with the default ones use KV instead.
+func (node *ZabNode) Submit(command []byte) {
+	node.submitWrite(node.newWrite(command, nil))
+}
+
+func (node *ZabNode) submitWrite(write ZabWrite) {
+	if node.phase != 3 {
+		return
+	}
+	err := node.sendWrite(write)
+	if err != nil {
+		util.Logger.Println("failed to send write to", node.leaderId, err)
+	}
+}
+
+func (node *ZabNode) newWrite(command []byte, reconfig *ZabReconfig) ZabWrite {
+	if node.nextSeq == 0 {
+		node.session = ZabSession{node.id, node.clock.Now().UnixNano()}
+	}
+	if len(node.uncommitted) == 0 {
+		node.lastWriteProgress = node.clock.Now()
+	}
+	node.nextSeq++
+	node.latency.sent(node.nextSeq, node.clock.Now())
+	write := ZabWrite{node.session, node.nextSeq, command, reconfig}
+	node.uncommitted = append(node.uncommitted, write)
+	return write
+}
+
+func (node *ZabNode) sendWrite(write ZabWrite) error {
+	return node.SendHelper(node.leaderId, ZabMessage{
+		SenderId: node.id,
+		MsgType:  WRITE_REQUEST,
+		ZabProposalAckCommit: ZabProposalAckCommit{
+			Counter: -1, // can be anything
+			Epoch:   -1, // can be anything
+			Write:   write,
+		},
+	})
+}
+
+// resendWrites sends every write that has not committed yet to the
+//   leader, in order
+func (node *ZabNode) resendWrites() {
+	if len(node.uncommitted) > 0 {
+		fmt.Println("resending", len(node.uncommitted), "uncommitted writes to", node.leaderId)
+	}
+	node.lastWriteProgress = node.clock.Now()
+	for _, write := range node.uncommitted {
+		node.sendWrite(write)
+	}
+}
+
+// writeTick resends our writes if none of them has committed in a while,
+//   since the leader drops anything that arrives out of order
+func (node *ZabNode) writeTick() {
+	if len(node.uncommitted) > 0 && node.clock.Now().Sub(node.lastWriteProgress) >= node.writeRetryTimeout {
+		node.resendWrites()
+	}
+}
+
+// applyWrite applies a committed write unless its session already has it.
+//   A reconfiguration is applied by commit, from the proposal's config.
+func (node *ZabNode) applyWrite(write ZabWrite) {
+	if write.Seq <= node.sessions[write.Session] || superseded(node.sessions, write.Session) {
+		return
+	}
+	if write.Reconfig != nil {
+		// nothing for the state machine
+	} else if err := node.sm.Apply(write.Command); err != nil {
+		util.Logger.Println("failed to apply write", write.Seq, "from", write.Session.NodeId, err)
+	}
+	if _, ok := node.sessions[write.Session]; !ok {
+		dropOlderSessions(node.sessions, write.Session)
+	}
+	node.sessions[write.Session] = write.Seq
+
+	if write.Session == node.session {
+		node.latency.committed(write.Seq, node.clock.Now())
+		committed := 0
+		for committed < len(node.uncommitted) && node.uncommitted[committed].Seq <= write.Seq {
+			committed++
+		}
+		node.uncommitted = node.uncommitted[committed:]
+		node.lastWriteProgress = node.clock.Now()
+	}
+}
+
+func (node *ZabNode) CommitLatency() (time.Duration, int) {
+	return node.latency.mean()
+}
+
+// superseded reports whether a later run of the same node has a session
+//   in sessions
+func superseded(sessions map[ZabSession]int, session ZabSession) bool {
+	for other := range sessions {
+		if other.NodeId == session.NodeId && other.Start > session.Start {
+			return true
+		}
+	}
+	return false
+}
+
+// dropOlderSessions forgets the sessions of earlier runs of session's node
+func dropOlderSessions[V any](sessions map[ZabSession]V, session ZabSession) {
+	for other := range sessions {
+		if other.NodeId == session.NodeId && other.Start < session.Start {
+			delete(sessions, other)
+		}
+	}
+}
+
+func copySessions(sessions map[ZabSession]int) map[ZabSession]int {
+	copied := make(map[ZabSession]int, len(sessions))
+	for session, seq := range sessions {
+		copied[session] = seq
+	}
+	return copied
+}
+
+/****************************************************************************************************/
+/***************************************Leader*******************************************************/
+/****************************************************************************************************/
+
+// acceptWrite batches the write if it is the next one in its session.
+//   Writes from further ahead are held until the gap is filled.
+func (node *ZabNode) acceptWrite(write ZabWrite) {
+	if superseded(node.proposedSeqs, write.Session) {
+		util.Logger.Println("dropping write", write.Seq, "from an earlier run of", write.Session.NodeId)
+		return
+	}
+	last, ok := node.proposedSeqs[write.Session]
+	if !ok {
+		last = node.sessions[write.Session]
+		dropOlderSessions(node.proposedSeqs, write.Session)
+		dropOlderSessions(node.heldWrites, write.Session)
+	}
+	if write.Seq <= last {
+		util.Logger.Println("dropping duplicate write", write.Seq, "from", write.Session.NodeId)
+		return
+	}
+	if write.Seq > last+1 {
+		if node.heldWrites[write.Session] == nil {
+			node.heldWrites[write.Session] = make(map[int]ZabWrite)
+		}
+		node.heldWrites[write.Session][write.Seq] = write
+		return
+	}
+
+	for {
+		node.proposedSeqs[write.Session] = write.Seq
+		node.addToBatch(write)
+
+		held := node.heldWrites[write.Session]
+		next, ok := held[write.Seq+1]
+		if !ok {
+			break
+		}
+		delete(held, next.Seq)
+		write = next
+	}
+}
+
+// startProposing runs when we start leading an epoch, at which point
+//   everything in our history is committed
+func (node *ZabNode) startProposing() {
+	node.proposedSeqs = copySessions(node.sessions)
+	node.heldWrites = make(map[ZabSession]map[int]ZabWrite)
+}
@@ -0,0 +1,111 @@
+package protocols
+
+import (
+	"flads/util"
+	"fmt"
+)
+
+// ZabSnapshot is the state machine, the session table and the config with
+//   every proposal up to and including Zxid applied. Once a snapshot is taken, the history only keeps what comes
+//   after it, and syncing followers get the snapshot plus that tail
+//   instead of every gradient since the beginning of training.
+type ZabSnapshot struct {
+	Zxid     ZabZxid
+	State    []byte
+	Sessions map[ZabSession]int
+	Config   ZabConfig
+}
+
+func (zxid ZabZxid) after(other ZabZxid) bool {
+	if zxid.Epoch != other.Epoch {
+		return zxid.Epoch > other.Epoch
+	}
+	return zxid.Counter > other.Counter
+}
+
+func (p *ZabProposalAckCommit) zxid() ZabZxid {
+	return ZabZxid{p.Epoch, p.Counter}
+}
+
+// SetSnapshotInterval sets how many commits go by between snapshots, 0
+//   turns snapshotting off
+func (node *ZabNode) SetSnapshotInterval(commits int) {
+	node.snapshotInterval = commits
+}
+
+func (node *ZabNode) maybeSnapshot() {
+	node.commitsSinceSnapshot++
+	if node.snapshotInterval > 0 && node.commitsSinceSnapshot >= node.snapshotInterval {
+		node.takeSnapshot()
+	}
+}
+
+// takeSnapshot captures the state machine at the last commit and compacts
+//   the history up to it
+func (node *ZabNode) takeSnapshot() {
+	state, err := node.sm.Snapshot()
+	if err != nil {
+		util.Logger.Println("failed to snapshot the state machine, keeping the full history:", err)
+		return
+	}
+	snapshot := &ZabSnapshot{node.lastCommitted, state, copySessions(node.sessions), node.config}
+	if err := node.storage.SaveSnapshot(*snapshot); err != nil {
+		util.Logger.Println("failed to save snapshot, keeping the full history:", err)
+		return
+	}
+	node.snapshot = snapshot
+	node.commitsSinceSnapshot = 0
+
+	node.history = node.historyAfter(snapshot.Zxid)
+	if err := node.storage.ReplaceHistory(node.history); err != nil {
+		util.Logger.Println("failed to compact the log:", err)
+	}
+	util.Logger.Printf("took snapshot at (%d, %d), %d proposals left in history\n",
+		snapshot.Zxid.Epoch, snapshot.Zxid.Counter, len(node.history))
+}
+
+// installSnapshot replaces the state machine with snapshot if it is ahead of what
+//   we have applied, and drops the history it covers
+func (node *ZabNode) installSnapshot(snapshot *ZabSnapshot) error {
+	if snapshot == nil || !snapshot.Zxid.after(node.lastCommitted) {
+		return nil
+	}
+	if err := node.sm.Restore(snapshot.State); err != nil {
+		return fmt.Errorf("restoring snapshot: %v", err)
+	}
+	if err := node.storage.SaveSnapshot(*snapshot); err != nil {
+		return fmt.Errorf("saving snapshot: %v", err)
+	}
+	node.sessions = copySessions(snapshot.Sessions)
+	node.snapshot = snapshot
+	node.lastCommitted = snapshot.Zxid
+	node.commitsSinceSnapshot = 0
+	node.history = node.historyAfter(snapshot.Zxid)
+	// snapshots from before reconfiguration have no config
+	if snapshot.Config.Members != nil {
+		node.applyConfig(snapshot.Config)
+	}
+	node.completeReconfigs()
+	fmt.Printf("installed snapshot at (%d, %d)\n", snapshot.Zxid.Epoch, snapshot.Zxid.Counter)
+	return nil
+}
+
+// historyAfter returns a copy of the proposals after zxid, so the
+//   compacted prefix can be garbage collected
+func (node *ZabNode) historyAfter(zxid ZabZxid) []ZabProposalAckCommit {
+	tail := make([]ZabProposalAckCommit, 0)
+	for _, proposal := range node.history {
+		if proposal.zxid().after(zxid) {
+			tail = append(tail, proposal)
+		}
+	}
+	return tail
+}
+
+// commitHistory applies everything in the history that has not been
+//   applied yet. Used once a new leader's history is established, since
+//   all of it is committed at that point.
+func (node *ZabNode) commitHistory() {
+	epoch, counter := node.getLastZxid()
+	node.commitThrough(ZabZxid{epoch, counter})
+}
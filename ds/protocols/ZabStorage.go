@@ -0,0 +1,313 @@
+package protocols
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ZabStorage is where a ZabNode keeps the state that must survive a
+//   crash: its epochs and its proposal history. Every method must be
+//   durable by the time it returns, since the node acks right after.
+type ZabStorage interface {
+	SaveEpochs(acceptedEpoch int, currentEpoch int) error
+	LoadEpochs() (acceptedEpoch int, currentEpoch int, err error)
+
+	AppendProposal(proposal ZabProposalAckCommit) error
+	ReplaceHistory(history []ZabProposalAckCommit) error
+	LoadHistory() ([]ZabProposalAckCommit, error)
+
+	// LoadSnapshot returns nil if no snapshot was ever saved
+	SaveSnapshot(snapshot ZabSnapshot) error
+	LoadSnapshot() (*ZabSnapshot, error)
+}
+
+/****************************************************************************************************/
+/***************************************Memory*******************************************************/
+/****************************************************************************************************/
+
+// MemoryZabStorage keeps everything in memory, so nothing survives a
+//   restart. It is the default.
+type MemoryZabStorage struct {
+	acceptedEpoch int
+	currentEpoch  int
+	history       []ZabProposalAckCommit
+	snapshot      *ZabSnapshot
+}
+
+func (storage *MemoryZabStorage) SaveEpochs(acceptedEpoch int, currentEpoch int) error {
+	storage.acceptedEpoch = acceptedEpoch
+	storage.currentEpoch = currentEpoch
+	return nil
+}
+
+func (storage *MemoryZabStorage) LoadEpochs() (int, int, error) {
+	return storage.acceptedEpoch, storage.currentEpoch, nil
+}
+
+func (storage *MemoryZabStorage) AppendProposal(proposal ZabProposalAckCommit) error {
+	storage.history = append(storage.history, proposal)
+	return nil
+}
+
+func (storage *MemoryZabStorage) ReplaceHistory(history []ZabProposalAckCommit) error {
+	storage.history = append([]ZabProposalAckCommit{}, history...)
+	return nil
+}
+
+func (storage *MemoryZabStorage) LoadHistory() ([]ZabProposalAckCommit, error) {
+	return append([]ZabProposalAckCommit{}, storage.history...), nil
+}
+
+func (storage *MemoryZabStorage) SaveSnapshot(snapshot ZabSnapshot) error {
+	storage.snapshot = &snapshot
+	return nil
+}
+
+func (storage *MemoryZabStorage) LoadSnapshot() (*ZabSnapshot, error) {
+	return storage.snapshot, nil
+}
+
+/****************************************************************************************************/
+/***************************************File*********************************************************/
+/****************************************************************************************************/
+
+const (
+	epochsFileName   = "epochs"
+	logFileName      = "log"
+	snapshotFileName = "snapshot"
+	// a proposal is a batch of writes, well under this even with gradients
+	maxRecordLength = 256 << 20
+)
+
+// errTornRecord marks a record cut short by the end of the log
+var errTornRecord = errors.New("torn record")
+
+type zabEpochs struct {
+	AcceptedEpoch int
+	CurrentEpoch  int
+}
+
+// FileZabStorage keeps the epochs and the latest snapshot in files that
+//   are replaced atomically, and the history in an append-only log of
+//   length- and checksum-prefixed gob records. Every write is fsynced. A torn record at
+//   the end of the log (from a crash mid-append) is dropped on load, any
+//   other bad record fails the load.
+type FileZabStorage struct {
+	dir string
+	log *os.File
+}
+
+func MakeFileZabStorage(dir string) (*FileZabStorage, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	log, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	storage := FileZabStorage{dir, log}
+	return &storage, nil
+}
+
+func (storage *FileZabStorage) Close() error {
+	return storage.log.Close()
+}
+
+func (storage *FileZabStorage) SaveEpochs(acceptedEpoch int, currentEpoch int) error {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(zabEpochs{acceptedEpoch, currentEpoch})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(storage.dir, epochsFileName), buffer.Bytes())
+}
+
+func (storage *FileZabStorage) LoadEpochs() (int, int, error) {
+	data, err := os.ReadFile(filepath.Join(storage.dir, epochsFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	var epochs zabEpochs
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&epochs)
+	return epochs.AcceptedEpoch, epochs.CurrentEpoch, err
+}
+
+func (storage *FileZabStorage) AppendProposal(proposal ZabProposalAckCommit) error {
+	record, err := encodeRecord(proposal)
+	if err != nil {
+		return err
+	}
+	_, err = storage.log.Write(record)
+	if err != nil {
+		return err
+	}
+	return storage.log.Sync()
+}
+
+func (storage *FileZabStorage) ReplaceHistory(history []ZabProposalAckCommit) error {
+	var buffer bytes.Buffer
+	for _, proposal := range history {
+		record, err := encodeRecord(proposal)
+		if err != nil {
+			return err
+		}
+		buffer.Write(record)
+	}
+
+	path := filepath.Join(storage.dir, logFileName)
+	err := writeFileAtomic(path, buffer.Bytes())
+	if err != nil {
+		return err
+	}
+
+	// the old handle still points at the replaced file
+	log, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	storage.log.Close()
+	storage.log = log
+	return nil
+}
+
+func (storage *FileZabStorage) LoadHistory() ([]ZabProposalAckCommit, error) {
+	_, err := storage.log.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]ZabProposalAckCommit, 0)
+	reader := bufio.NewReader(storage.log)
+	validLength := int64(0)
+	for {
+		proposal, n, err := decodeRecord(reader)
+		if err == io.EOF {
+			break
+		} else if errors.Is(err, errTornRecord) {
+			fmt.Println("dropping torn record at the end of the zab log:", err)
+			if err := storage.log.Truncate(validLength); err != nil {
+				return nil, err
+			}
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("bad record at offset %d of the zab log: %v", validLength, err)
+		}
+		history = append(history, proposal)
+		validLength += n
+	}
+	return history, nil
+}
+
+func (storage *FileZabStorage) SaveSnapshot(snapshot ZabSnapshot) error {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(snapshot)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(storage.dir, snapshotFileName), buffer.Bytes())
+}
+
+func (storage *FileZabStorage) LoadSnapshot() (*ZabSnapshot, error) {
+	data, err := os.ReadFile(filepath.Join(storage.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var snapshot ZabSnapshot
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// record layout: | length (4) | crc32 of payload (4) | gob payload |
+func encodeRecord(proposal ZabProposalAckCommit) ([]byte, error) {
+	var payload bytes.Buffer
+	err := gob.NewEncoder(&payload).Encode(proposal)
+	if err != nil {
+		return nil, err
+	}
+	if payload.Len() > maxRecordLength {
+		return nil, fmt.Errorf("proposal is %d bytes, more than the %d a record can hold", payload.Len(), maxRecordLength)
+	}
+
+	record := make([]byte, 8, 8+payload.Len())
+	binary.BigEndian.PutUint32(record[0:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	return append(record, payload.Bytes()...), nil
+}
+
+func decodeRecord(reader io.Reader) (ZabProposalAckCommit, int64, error) {
+	var proposal ZabProposalAckCommit
+
+	header := make([]byte, 8)
+	n, err := io.ReadFull(reader, header)
+	if err == io.EOF {
+		return proposal, 0, io.EOF
+	} else if err != nil {
+		return proposal, 0, fmt.Errorf("%w: short header (%d bytes): %v", errTornRecord, n, err)
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordLength {
+		return proposal, 0, fmt.Errorf("record length %d is over %d", length, maxRecordLength)
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return proposal, 0, fmt.Errorf("%w: short payload: %v", errTornRecord, err)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return proposal, 0, errors.New("checksum mismatch")
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&proposal)
+	return proposal, int64(len(header) + len(payload)), err
+}
+
+// writeFileAtomic writes to a temporary file, fsyncs it and renames it
+//   over path, so readers see either the old or the new contents
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
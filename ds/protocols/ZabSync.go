@@ -0,0 +1,114 @@
+package protocols
+
+import (
+	"fmt"
+)
+
+// Synchronization (phase 2), modelled on ZooKeeper. The leader looks at
+//   the LastZxid each follower reported and sends only what that follower
+//   is missing:
+//   - DIFF: the proposals after the follower's last zxid
+//   - TRUNC: the follower has proposals the leader never saw (uncommitted
+//     leftovers from an old epoch), so it drops everything after
+//     TruncZxid first, then applies the proposals after it
+//   - SNAP: the follower is behind the leader's snapshot, so it gets the
+//     snapshot and the history after it
+
+type ZabSyncMode string
+
+const (
+	DIFF  = "DIFF"
+	TRUNC = "TRUNC"
+	SNAP  = "SNAP"
+)
+
+// syncFor builds the NEWLEADER payload for a follower whose last zxid is
+//   lastZxid
+func (node *ZabNode) syncFor(lastZxid ZabZxid) ZabViewChange {
+	if node.snapshot != nil && node.snapshot.Zxid.after(lastZxid) {
+		return ZabViewChange{
+			Sync:     SNAP,
+			Snapshot: node.snapshot,
+			History:  node.history,
+		}
+	}
+
+	if !node.hasZxid(lastZxid) {
+		truncZxid := node.lastZxidNotAfter(lastZxid)
+		return ZabViewChange{
+			Sync:      TRUNC,
+			TruncZxid: truncZxid,
+			History:   node.historyAfter(truncZxid),
+		}
+	}
+
+	return ZabViewChange{
+		Sync:    DIFF,
+		History: node.historyAfter(lastZxid),
+	}
+}
+
+// applySync brings our history in line with the leader's and persists it.
+//   Nothing is applied to the model here, that happens on COMMITNEWLEADER.
+func (node *ZabNode) applySync(view *ZabViewChange) error {
+	switch view.Sync {
+	case SNAP:
+		if err := node.installSnapshot(view.Snapshot); err != nil {
+			return err
+		}
+		node.history = append([]ZabProposalAckCommit{}, view.History...)
+		return node.storage.ReplaceHistory(node.history)
+	case TRUNC:
+		kept := make([]ZabProposalAckCommit, 0)
+		for _, proposal := range node.history {
+			if !proposal.zxid().after(view.TruncZxid) {
+				kept = append(kept, proposal)
+			}
+		}
+		node.history = append(kept, view.History...)
+		return node.storage.ReplaceHistory(node.history)
+	case DIFF:
+		for _, proposal := range view.History {
+			if err := node.storage.AppendProposal(proposal); err != nil {
+				return err
+			}
+			node.insertProposal(proposal)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown sync mode %q", view.Sync)
+	}
+}
+
+// hasZxid reports whether zxid is a point in our history a follower can
+//   continue from: the start, our snapshot, or one of our proposals
+func (node *ZabNode) hasZxid(zxid ZabZxid) bool {
+	if node.snapshot != nil {
+		if node.snapshot.Zxid == zxid {
+			return true
+		}
+	} else if zxid == (ZabZxid{-1, -1}) {
+		return true
+	}
+	for _, proposal := range node.history {
+		if proposal.zxid() == zxid {
+			return true
+		}
+	}
+	return false
+}
+
+// lastZxidNotAfter returns the newest point in our history that is not
+//   after zxid, which is where a diverged follower has to truncate to
+func (node *ZabNode) lastZxidNotAfter(zxid ZabZxid) ZabZxid {
+	last := ZabZxid{-1, -1}
+	if node.snapshot != nil {
+		last = node.snapshot.Zxid
+	}
+	for _, proposal := range node.history {
+		if !proposal.zxid().after(zxid) && proposal.zxid().after(last) {
+			last = proposal.zxid()
+		}
+	}
+	return last
+}
@@ -0,0 +1,143 @@
+package protocols
+
+import (
+	"errors"
+	"flads/util"
+	"fmt"
+	"time"
+)
+
+// Leadership transfer hands the leader role to a chosen follower without
+//   waiting for heartbeats to time out. The leader stops taking writes,
+//   lets everything it proposed commit and then sends TRANSFER with its
+//   last zxid to the target, repeating it until the target has that zxid
+//   committed. The target answers with TRANSFERACK and goes straight to
+//   discovery as the prospective leader, the old leader tells everyone else
+//   to follow it with STEPDOWN and follows it too. Discovery and
+//   synchronization then run as after any election, so the new leader
+//   still needs a quorum to start its epoch.
+//
+//   Writes dropped during the transfer are still uncommitted at their
+//   sender, who resends them to the new leader. If the target does not
+//   take over within recoveryTimeout the leader goes back to normal.
+
+// TransferLeadership makes the leader hand over to target once target has
+//   caught up
+func (node *ZabNode) TransferLeadership(target int) error {
+	if node.phase != 3 || node.leaderId != node.id {
+		return errors.New("only the leader can transfer leadership")
+	}
+	if target == node.id || !node.isVoter(target) {
+		return fmt.Errorf("node %d cannot take over leadership", target)
+	}
+	fmt.Println("transferring leadership to", target)
+	node.transferTarget = target
+	node.transferStarted = node.clock.Now()
+	node.lastTransferSent = node.transferStarted.Add(-node.electionTimeout)
+	return nil
+}
+
+// transferTick sends TRANSFER once nothing is left to commit
+func (node *ZabNode) transferTick() {
+	if node.transferTarget == -1 {
+		return
+	}
+	now := node.clock.Now()
+	if now.Sub(node.transferStarted) >= node.recoveryTimeout {
+		fmt.Println("leadership transfer to", node.transferTarget, "timed out")
+		node.transferTarget = -1
+		return
+	}
+	node.flushBatch()
+	if len(node.batch) > 0 || len(node.inFlight) > 0 || now.Sub(node.lastTransferSent) < node.electionTimeout {
+		return
+	}
+	node.lastTransferSent = now
+	epoch, counter := node.getLastZxid()
+	node.SendHelper(node.transferTarget, ZabMessage{
+		SenderId: node.id,
+		Epoch:    node.currentEpoch,
+		MsgType:  TRANSFER,
+		ZabViewChange: ZabViewChange{
+			LastZxid: ZabZxid{epoch, counter},
+		},
+	})
+}
+
+func (node *ZabNode) handleTransfer(msg *ZabMessage) {
+	if node.phase == 1 && node.leaderId == node.id {
+		// we took over already, our TRANSFERACK got lost
+		node.sendTransferAck(msg.SenderId, msg.Epoch)
+		return
+	}
+	if node.phase != 3 || msg.SenderId != node.leaderId || msg.Epoch != node.currentEpoch {
+		return
+	}
+	epoch, counter := node.getLastZxid()
+	if (ZabZxid{epoch, counter}) != msg.LastZxid || node.lastCommitted != msg.LastZxid {
+		util.Logger.Println("not taking over from", msg.SenderId, "until we have committed everything it has")
+		return
+	}
+	fmt.Println("taking over leadership from", msg.SenderId)
+	node.sendTransferAck(msg.SenderId, msg.Epoch)
+	node.handOver(node.id)
+}
+
+func (node *ZabNode) sendTransferAck(leaderId int, epoch int) {
+	node.SendHelper(leaderId, ZabMessage{
+		SenderId: node.id,
+		Epoch:    epoch,
+		MsgType:  TRANSFERACK,
+	})
+}
+
+func (node *ZabNode) handleTransferAck(msg *ZabMessage) {
+	if node.leaderId != node.id || msg.SenderId != node.transferTarget || msg.Epoch != node.currentEpoch {
+		return
+	}
+	target := node.transferTarget
+	stepDown := ZabMessage{
+		SenderId: node.id,
+		Epoch:    node.currentEpoch,
+		MsgType:  STEPDOWN,
+		Vote:     ZabVote{LeaderId: target, CurrentEpoch: node.currentEpoch},
+	}
+	for _, id := range node.members() {
+		if id != node.id && id != target {
+			node.SendHelper(id, stepDown)
+		}
+	}
+	node.handOver(target)
+}
+
+// handleStepDown follows the leader our leader handed over to. Observers
+//   look for the new leader from scratch.
+func (node *ZabNode) handleStepDown(msg *ZabMessage) {
+	if msg.SenderId != node.leaderId {
+		return
+	}
+	if node.isObserver(node.id) {
+		node.reset = true
+		return
+	}
+	if msg.Epoch != node.currentEpoch {
+		return
+	}
+	node.handOver(msg.Vote.LeaderId)
+}
+
+// handOver leaves phase 3 for discovery under leaderId, without an
+//   election
+func (node *ZabNode) handOver(leaderId int) {
+	node.clearLeaderState()
+	node.stopHeartbeat()
+	// the old leader stopped serving reads when the transfer started
+	node.leaderLease = time.Time{}
+	node.leaderId = leaderId
+	node.phase = 1
+	node.phaseDeadline = node.clock.Now().Add(node.recoveryTimeout)
+	fmt.Println("following", leaderId, "after a leadership transfer - entering phase 1")
+	if leaderId != node.id {
+		node.sendFollowerInfo()
+	}
+}
@@ -0,0 +1,151 @@
+package sim
+
+import (
+	"container/heap"
+	"flads/util"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"time"
+)
+
+// Scheduler is a discrete-event loop with a virtual clock. Events run one
+//   at a time in (time, insertion order), and every random choice is drawn
+//   from one seeded source, so a seed always replays the same run.
+//   Scheduler implements util.Clock, so it can be handed to nodes and
+//   networks directly.
+type Scheduler struct {
+	now    time.Time
+	seq    uint64
+	events eventHeap
+	rng    *rand.Rand
+
+	trace       []string
+	fingerprint uint64
+}
+
+type event struct {
+	at    time.Time
+	seq   uint64
+	label string
+	f     func()
+	done  bool
+}
+
+var _ util.Clock = &Scheduler{}
+
+func MakeScheduler(seed int64) *Scheduler {
+	scheduler := Scheduler{
+		now:         time.Unix(0, 0),
+		rng:         rand.New(rand.NewSource(seed)),
+		fingerprint: fnv.New64a().Sum64(),
+	}
+	return &scheduler
+}
+
+func (scheduler *Scheduler) Now() time.Time {
+	return scheduler.now
+}
+
+func (scheduler *Scheduler) AfterFunc(d time.Duration, f func()) util.Timer {
+	return scheduler.Schedule("timer", d, f)
+}
+
+// Schedule runs f after d of virtual time. The label only shows up in the
+//   trace.
+func (scheduler *Scheduler) Schedule(label string, d time.Duration, f func()) util.Timer {
+	if d < 0 {
+		d = 0
+	}
+	e := &event{
+		at:    scheduler.now.Add(d),
+		seq:   scheduler.seq,
+		label: label,
+		f:     f,
+	}
+	scheduler.seq++
+	heap.Push(&scheduler.events, e)
+	return e
+}
+
+func (scheduler *Scheduler) Rand() *rand.Rand {
+	return scheduler.rng
+}
+
+// Step runs the next pending event, returning false if there is none
+func (scheduler *Scheduler) Step() bool {
+	for scheduler.events.Len() > 0 {
+		e := heap.Pop(&scheduler.events).(*event)
+		if e.done {
+			continue
+		}
+		e.done = true
+		scheduler.now = e.at
+		scheduler.record(e)
+		e.f()
+		return true
+	}
+	return false
+}
+
+// RunFor runs every event due in the next d of virtual time
+func (scheduler *Scheduler) RunFor(d time.Duration) {
+	end := scheduler.now.Add(d)
+	for scheduler.events.Len() > 0 && !scheduler.events[0].at.After(end) {
+		scheduler.Step()
+	}
+	scheduler.now = end
+}
+
+func (scheduler *Scheduler) Trace() []string {
+	return scheduler.trace
+}
+
+// Fingerprint is a hash over every event run so far; two runs with the
+//   same fingerprint had the same interleaving
+func (scheduler *Scheduler) Fingerprint() uint64 {
+	return scheduler.fingerprint
+}
+
+func (scheduler *Scheduler) record(e *event) {
+	entry := fmt.Sprintf("%v %d %s", e.at.Sub(time.Unix(0, 0)), e.seq, e.label)
+	scheduler.trace = append(scheduler.trace, entry)
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d %s", scheduler.fingerprint, entry)
+	scheduler.fingerprint = h.Sum64()
+}
+
+func (e *event) Stop() bool {
+	wasPending := !e.done
+	e.done = true
+	return wasPending
+}
+
+type eventHeap []*event
+
+func (h eventHeap) Len() int {
+	return len(h)
+}
+
+func (h eventHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+
+func (h eventHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *eventHeap) Push(x any) {
+	*h = append(*h, x.(*event))
+}
+
+func (h *eventHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,33 @@
+package sim
+
+import (
+	"context"
+	"errors"
+	"flads/ds/network"
+	"time"
+)
+
+var ErrWouldBlock = errors.New("receive would block in simulation")
+
+// simEndpoint is a DumbNetwork endpoint that never blocks. Virtual time
+//   only moves between scheduler events, so a receive that waits could
+//   never be woken up; it returns whatever has been delivered instead.
+//   Messages() is inherited but hands delivery to a goroutine, so nodes
+//   that use it are not deterministic.
+type simEndpoint[T any] struct {
+	*network.DumbNetworkEndpoint[T]
+}
+
+var _ network.Network[int] = simEndpoint[int]{}
+
+func (endpoint simEndpoint[T]) ReceiveTimeout(d time.Duration) (msg T, ok bool) {
+	return endpoint.Receive()
+}
+
+func (endpoint simEndpoint[T]) ReceiveContext(ctx context.Context) (T, error) {
+	msg, ok := endpoint.Receive()
+	if !ok {
+		return msg, ErrWouldBlock
+	}
+	return msg, nil
+}
@@ -0,0 +1,134 @@
+package sim
+
+import (
+	"flads/ds/network"
+	"flads/ds/protocols"
+	"flads/ml"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Simulator runs a whole cluster of nodes in one goroutine on a virtual
+//   clock. Nodes are stepped (Run) at seeded, jittered intervals and talk
+//   over in-process networks wrapped in a FaultyNetwork driven by the same
+//   scheduler, so a seed fully determines the interleaving. T is the
+//   protocol message type and H the heartbeat message type.
+type Simulator[T any, H any] struct {
+	seed         int64
+	numNodes     int
+	scheduler    *Scheduler
+	injector     *network.FaultInjector
+	nodes        map[int]protocols.Node[T, H]
+	crashed      map[int]bool
+	stepInterval time.Duration
+}
+
+func MakeSimulator[T any, H any](seed int64, numNodes int, stepInterval time.Duration,
+	makeNode func(id int) protocols.Node[T, H], makeML func(id int) ml.MLProcess) *Simulator[T, H] {
+
+	scheduler := MakeScheduler(seed)
+	injector := network.MakeFaultInjector(scheduler.Rand().Int63())
+	injector.SetClock(scheduler)
+	injector.SetDefaultFaults(network.LinkFaults{
+		Latency: network.UniformLatency(time.Millisecond, 10*time.Millisecond),
+	})
+
+	sim := Simulator[T, H]{
+		seed:         seed,
+		numNodes:     numNodes,
+		scheduler:    scheduler,
+		injector:     injector,
+		nodes:        make(map[int]protocols.Node[T, H]),
+		crashed:      make(map[int]bool),
+		stepInterval: stepInterval,
+	}
+
+	hub := network.DumbNetwork[T]{}
+	hub.Initialize(numNodes)
+	heartbeatHub := network.DumbNetwork[H]{}
+	heartbeatHub.Initialize(numNodes)
+
+	nodeIdTable := make(map[int]string)
+	for id := 0; id < numNodes; id++ {
+		nodeIdTable[id] = fmt.Sprintf("sim:%d", id)
+	}
+
+	for id := 0; id < numNodes; id++ {
+		endpoint := hub.Endpoint(id)
+		endpoint.Listen()
+		net := network.MakeFaultyNetwork[T](simEndpoint[T]{endpoint}, id, nodeIdTable, injector)
+
+		heartbeatEndpoint := heartbeatHub.Endpoint(id)
+		heartbeatEndpoint.Listen()
+		heartbeatNet := network.MakeFaultyNetwork[H](simEndpoint[H]{heartbeatEndpoint}, id, nodeIdTable, injector)
+
+		node := makeNode(id)
+		node.Initialize(id, strconv.Itoa(id), makeML(id), net, heartbeatNet, numNodes, -1)
+		if clocked, ok := node.(protocols.Clocked); ok {
+			clocked.SetClock(scheduler)
+		}
+		sim.nodes[id] = node
+
+		sim.scheduleStep(id, sim.jitter())
+	}
+
+	return &sim
+}
+
+func (sim *Simulator[T, H]) Seed() int64 {
+	return sim.seed
+}
+
+func (sim *Simulator[T, H]) Scheduler() *Scheduler {
+	return sim.scheduler
+}
+
+// Injector can be used to add faults and partitions during the run
+func (sim *Simulator[T, H]) Injector() *network.FaultInjector {
+	return sim.injector
+}
+
+func (sim *Simulator[T, H]) Node(id int) protocols.Node[T, H] {
+	return sim.nodes[id]
+}
+
+func (sim *Simulator[T, H]) RunFor(d time.Duration) {
+	sim.scheduler.RunFor(d)
+}
+
+// Crash stops stepping the node and cuts it off from every other node.
+//   Its own timers keep firing, but nothing they send gets through.
+func (sim *Simulator[T, H]) Crash(id int) {
+	sim.crashed[id] = true
+
+	others := make([]int, 0, sim.numNodes-1)
+	for other := 0; other < sim.numNodes; other++ {
+		if other != id {
+			others = append(others, other)
+		}
+	}
+	sim.injector.Partition(crashPartition(id), []int{id}, others)
+}
+
+func (sim *Simulator[T, H]) Recover(id int) {
+	delete(sim.crashed, id)
+	sim.injector.Heal(crashPartition(id))
+}
+
+func crashPartition(id int) string {
+	return fmt.Sprintf("crash-%d", id)
+}
+
+func (sim *Simulator[T, H]) jitter() time.Duration {
+	return time.Duration(sim.scheduler.Rand().Int63n(int64(sim.stepInterval)/2 + 1))
+}
+
+func (sim *Simulator[T, H]) scheduleStep(id int, d time.Duration) {
+	sim.scheduler.Schedule(fmt.Sprintf("run %d", id), d, func() {
+		if !sim.crashed[id] {
+			sim.nodes[id].Run()
+		}
+		sim.scheduleStep(id, sim.stepInterval+sim.jitter())
+	})
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"flads/ds/network"
 	"flads/ds/protocols"
+	"flads/ds/sim"
 	"flads/ml"
 	"flads/util"
 	"flag"
@@ -23,11 +24,21 @@ const (
 	ALGO1 = iota
 	ALGO2
 	ZAB
+	RAFT
+	PBFT
 )
 
+var protocolModes = map[string]dssMode{
+	"algo1": ALGO1,
+	"algo2": ALGO2,
+	"zab":   ZAB,
+	"raft":  RAFT,
+	"pbft":  PBFT,
+}
+
 var device torch.Device
 
-func makeModel(trainDir string, nodeId int, useWholeDataset bool) (ml.MLProcess, string, string, string) {
+func makeModel(trainDir string, nodeId int, useWholeDataset bool, hyperparameters ml.Hyperparameters) (ml.MLProcess, string, string, string) {
 	if torch.IsCUDAAvailable() {
 		log.Println("CUDA is valid")
 		device = torch.NewDevice("cuda")
@@ -54,16 +65,13 @@ func makeModel(trainDir string, nodeId int, useWholeDataset bool) (ml.MLProcess,
 	// predictCmd := flag.NewFlagSet("predict", flag.ExitOnError)
 	// load := predictCmd.String("load", "/tmp/mnist_model.gob", "the model file")
 
-	lr := trainCmd.Float64("lr", .01, "learning rate")
-	epochs := trainCmd.Int("epochs", 10, "number of epochs")
-
 	// if len(os.Args) < 2 {
 	// 	fmt.Fprintf(os.Stderr, "Usage: %s needs subcomamnd train or predict\n", os.Args[0])
 	// 	os.Exit(1)
 	// }
 
 	// trainCmd.Parse(os.Args[2:])
-	model := ml.MakeSmallNN(*lr, *epochs, device)
+	model := ml.MakeSmallNN(hyperparameters.LearningRate, hyperparameters.Epochs, device)
 	return model, *trainTar, *testTar, *save
 }
 
@@ -77,23 +85,129 @@ func setup[T any](numNodes int, port string, curNodeId int, networkTable map[int
 	return &net
 }
 
+// Wraps net in a FaultyNetwork when fault injection is enabled
+func withFaults[T any](net network.Network[T], curNodeId int, networkTable map[int]string, injector *network.FaultInjector) network.Network[T] {
+	if injector == nil {
+		return net
+	}
+	return network.MakeFaultyNetwork(net, curNodeId, networkTable, injector)
+}
+
+// Runs numNodes Zab (or Raft, or PBFT) nodes with dumb models on a virtual clock.
+//   Rerunning with the same seed replays the exact same interleaving.
+func runSimulation(mode dssMode, numNodes int, seed int64, simTime time.Duration) {
+	makeML := func(id int) ml.MLProcess {
+		return ml.MakeDumbMLProcess(seed + int64(id))
+	}
+
+	var scheduler *sim.Scheduler
+	if mode == RAFT {
+		simulation := sim.MakeSimulator(seed, numNodes, 50*time.Millisecond,
+			func(id int) protocols.Node[protocols.RaftMessage, protocols.RaftMessage] {
+				return &protocols.RaftNode{}
+			}, makeML)
+		simulation.RunFor(simTime)
+		scheduler = simulation.Scheduler()
+	} else if mode == PBFT {
+		simulation := sim.MakeSimulator(seed, numNodes, 50*time.Millisecond,
+			func(id int) protocols.Node[protocols.PBFTMessage, protocols.PBFTMessage] {
+				node := &protocols.PBFTNode{}
+				// nobody in a simulation forges messages
+				node.SetKeys(protocols.MakeTestPBFTKeys(id, numNodes))
+				return node
+			}, makeML)
+		simulation.RunFor(simTime)
+		scheduler = simulation.Scheduler()
+	} else {
+		simulation := sim.MakeSimulator(seed, numNodes, 50*time.Millisecond,
+			func(id int) protocols.Node[protocols.ZabMessage, protocols.ZabHeartbeat] {
+				return &protocols.ZabNode{}
+			}, makeML)
+		simulation.RunFor(simTime)
+		scheduler = simulation.Scheduler()
+	}
+	fmt.Printf("seed %d: ran %d events, fingerprint %x\n", seed, len(scheduler.Trace()), scheduler.Fingerprint())
+}
+
+func logCommitLatency(stats protocols.CommitStats, epoch int) {
+	mean, commits := stats.CommitLatency()
+	log.Printf("Epoch: %d, commit latency: %v over %d commits", epoch, mean, commits)
+}
+
 func main() {
 
 	numNodesPtr := flag.Int("numNodes", 3, "Number of nodes in the network")
 	curNodeIdPtr := flag.Int("id", -1, "Current node id")
 	leaderIdPtr := flag.Int("leader", -1, "leaderId")
 	trainDirPtr := flag.String("trainDir", "data", "directory which contains node_id/mnist_png_training_shuffled.tar.gz")
+	dropRatePtr := flag.Float64("dropRate", 0, "probability of dropping each outgoing message")
+	maxLatencyPtr := flag.Duration("maxLatency", 0, "outgoing messages are delayed uniformly in [0, maxLatency)")
+	faultSeedPtr := flag.Int64("faultSeed", 1, "seed for the fault injector")
+	dataDirPtr := flag.String("dataDir", "", "directory for the zab log and epochs; empty keeps them in memory")
+	simulatePtr := flag.Bool("simulate", false, "run the whole cluster in a deterministic simulation")
+	seedPtr := flag.Int64("seed", 1, "seed for the simulation")
+	simTimePtr := flag.Duration("simTime", 30*time.Second, "virtual time to simulate")
+	snapshotIntervalPtr := flag.Int("snapshotInterval", 100, "commits between zab snapshots, 0 disables snapshots")
+	batchWindowPtr := flag.Duration("batchWindow", 20*time.Millisecond, "how long the zab leader waits to fill a batch")
+	batchSizePtr := flag.Int("batchSize", 8, "most write requests in one zab proposal")
+	maxInFlightPtr := flag.Int("maxInFlight", 4, "most zab proposals waiting for acks at once")
+	observersPtr := flag.String("observers", "", "comma separated ids of zab nodes that observe instead of voting")
+	recoveryPolicyPtr := flag.String("recoveryPolicy", protocols.ACCUMULATE, "what a zab node does with gradients while recovering: accumulate, average, drop-oldest or pause")
+	maxPendingPtr := flag.Int("maxPending", 16, "most gradients a zab node queues while recovering")
+	protocolPtr := flag.String("protocol", "zab", "ordering protocol: algo1, algo2, zab, raft or pbft")
+	keyDirPtr := flag.String("keyDir", "", "directory with the pbft keys, written by -genKeys")
+	insecureTestKeysPtr := flag.Bool("insecureTestKeys", false, "run pbft without -keyDir on test keys anyone can forge")
+	genKeysPtr := flag.Bool("genKeys", false, "write a pbft key pair per node to keyDir and exit")
+	lrPtr := flag.Float64("lr", .01, "learning rate; with zab the first committed config wins")
+	lrSchedulePtr := flag.String("lrSchedule", ml.CONSTANT_LR, "learning rate schedule: constant, step or exponential")
+	lrDecayEveryPtr := flag.Int("lrDecayEvery", 1000, "model updates between learning rate decays")
+	lrGammaPtr := flag.Float64("lrGamma", 0.5, "factor the learning rate decays by")
+	trainBatchSizePtr := flag.Int("trainBatchSize", 64, "training minibatch size")
+	epochsPtr := flag.Int("epochs", 10, "number of epochs")
+	addNodesPtr := flag.String("addNodes", "", "comma separated ids this node adds to the zab ensemble once it is running")
+	removeNodesPtr := flag.String("removeNodes", "", "comma separated ids this node removes from the zab ensemble once it is running")
+	failureDetectorPtr := flag.String("failureDetector", "phi", "how zab nodes suspect each other: phi (phi accrual) or timeout")
+	phiThresholdPtr := flag.Float64("phiThreshold", 8, "phi at which the phi accrual detector suspects a node")
+	heartbeatTimeoutPtr := flag.Duration("heartbeatTimeout", 5*time.Second, "silence after which the timeout detector suspects a node")
+	quorumGroupsPtr := flag.String("quorumGroups", "", "semicolon separated groups of comma separated zab voter ids for hierarchical quorums, e.g. 0,1,2;3,4,5")
+	quorumWeightsPtr := flag.String("quorumWeights", "", "comma separated id:weight pairs for hierarchical quorums, unlisted voters weigh 1")
+	swimPtr := flag.Bool("swim", false, "run swim gossip membership on port 9001+id and log who joins, leaves and fails")
 
 	flag.Parse()
 
 	numNodes := *numNodesPtr
+	hyperparameters := ml.Hyperparameters{
+		LearningRate: *lrPtr,
+		Schedule:     ml.LRSchedule{Kind: *lrSchedulePtr, Every: *lrDecayEveryPtr, Gamma: *lrGammaPtr},
+		BatchSize:    *trainBatchSizePtr,
+		Epochs:       *epochsPtr,
+	}
+	if err := hyperparameters.Validate(); err != nil {
+		panic(err)
+	}
 	curNodeId := *curNodeIdPtr
 	leaderId := *leaderIdPtr
-	dssMode := ZAB
+	mode, ok := protocolModes[*protocolPtr]
+	if !ok {
+		panic(fmt.Sprintf("unknown protocol %q", *protocolPtr))
+	}
+
+	if *genKeysPtr {
+		if err := protocols.GeneratePBFTKeys(*keyDirPtr, numNodes); err != nil {
+			panic(err)
+		}
+		return
+	}
 
 	util.InitPlotLogger(curNodeId, *trainDirPtr)
 
 	util.InitLogger(curNodeId)
+
+	if *simulatePtr {
+		runSimulation(mode, numNodes, *seedPtr, *simTimePtr)
+		return
+	}
+
 	if curNodeId >= numNodes || curNodeId < 0 {
 		panic("Cannot get the node id or node id out or range")
 	}
@@ -109,7 +223,7 @@ func main() {
 		heartbeatNetworkTable[i] = fmt.Sprintf("localhost:%d", 8001+i)
 	}
 
-	mlp, trainPath, testPath, _ := makeModel(*trainDirPtr, curNodeId, useWholeDataset)
+	mlp, trainPath, testPath, _ := makeModel(*trainDirPtr, curNodeId, useWholeDataset, hyperparameters)
 	util.Logger.Println("made model and began training")
 	vocab, e := imageloader.BuildLabelVocabularyFromTgz(trainPath)
 	if e != nil {
@@ -120,17 +234,30 @@ func main() {
 	var samples int
 	var trainLoss float32
 
+	var injector *network.FaultInjector
+	if *dropRatePtr > 0 || *maxLatencyPtr > 0 {
+		injector = network.MakeFaultInjector(*faultSeedPtr)
+		injector.SetDefaultFaults(network.LinkFaults{
+			DropRate: *dropRatePtr,
+			Latency:  network.UniformLatency(0, *maxLatencyPtr),
+		})
+	}
+
 	port := ":" + strings.Split(networkTable[curNodeId], ":")[1]
 	heartbeatPort := ":" + strings.Split(heartbeatNetworkTable[curNodeId], ":")[1]
 
-	if dssMode == ALGO1 {
+	if *swimPtr {
+		startSwim(curNodeId, numNodes, injector)
+	}
+
+	if mode == ALGO1 {
 		net := setup[protocols.Algo1Message](numNodes, port, curNodeId, networkTable, "tcp")
 		node := &protocols.Algo1Node{}
 		node.Initialize(curNodeId, strconv.Itoa(curNodeId), mlp, net, net, numNodes, 0)
-		for epoch := 0; epoch < 10; epoch++ {
+		for epoch := 0; epoch < hyperparameters.Epochs; epoch++ {
 			startTime := time.Now()
 			totalSamples = 0
-			trainLoader := ml.MNISTLoader(trainPath, vocab)
+			trainLoader := ml.MNISTLoaderWithBatchSize(trainPath, vocab, hyperparameters.BatchSize)
 			testLoader := ml.MNISTLoader(testPath, vocab)
 			for trainLoader.Scan() {
 				samples, trainLoss = mlp.TrainBatch(trainLoader)
@@ -141,14 +268,14 @@ func main() {
 			log.Printf("Train Epoch: %d, Loss: %.4f, throughput: %f samples/sec", epoch, trainLoss, throughput)
 			mlp.Test(testLoader, util.PlotLogger, epoch)
 		}
-	} else if dssMode == ALGO2 {
+	} else if mode == ALGO2 {
 		net := setup[protocols.Algo2Message](numNodes, port, curNodeId, networkTable, "tcp")
 		node := &protocols.Algo2Node{}
 		node.Initialize(curNodeId, strconv.Itoa(curNodeId), mlp, net, net, numNodes, 0)
-		for epoch := 0; epoch < 10; epoch++ {
+		for epoch := 0; epoch < hyperparameters.Epochs; epoch++ {
 			startTime := time.Now()
 			totalSamples = 0
-			trainLoader := ml.MNISTLoader(trainPath, vocab)
+			trainLoader := ml.MNISTLoaderWithBatchSize(trainPath, vocab, hyperparameters.BatchSize)
 			testLoader := ml.MNISTLoader(testPath, vocab)
 			for trainLoader.Scan() {
 				samples, trainLoss = mlp.TrainBatch(trainLoader)
@@ -159,30 +286,268 @@ func main() {
 			log.Printf("Train Epoch: %d, Loss: %.4f, throughput: %f samples/sec", epoch, trainLoss, throughput)
 			mlp.Test(testLoader, util.PlotLogger, epoch)
 		}
-	} else if dssMode == ZAB {
+	} else if mode == ZAB {
 		fmt.Println("running zab")
 		net := setup[protocols.ZabMessage](numNodes, port, curNodeId, networkTable, "tcp")
-		heartbeatNet := setup[int](numNodes, heartbeatPort, curNodeId, heartbeatNetworkTable, "udp")
+		net = withFaults(net, curNodeId, networkTable, injector)
+		heartbeatNet := setup[protocols.ZabHeartbeat](numNodes, heartbeatPort, curNodeId, heartbeatNetworkTable, "udp")
+		heartbeatNet = withFaults(heartbeatNet, curNodeId, heartbeatNetworkTable, injector)
 		node := &protocols.ZabNode{}
 		node.Initialize(curNodeId, strconv.Itoa(curNodeId), mlp, net, heartbeatNet, numNodes, leaderId)
-		for epoch := 0; epoch < 10; epoch++ {
+		node.SetSnapshotInterval(*snapshotIntervalPtr)
+		node.SetBatching(*batchWindowPtr, *batchSizePtr, *maxInFlightPtr)
+		observers := parseIds(*observersPtr)
+		node.SetObservers(observers)
+		if *quorumGroupsPtr != "" || *quorumWeightsPtr != "" {
+			groups := parseGroups(*quorumGroupsPtr, numNodes, observers)
+			if err := node.SetQuorumGroups(groups, parseWeights(*quorumWeightsPtr)); err != nil {
+				panic(err)
+			}
+		}
+		node.SetRecoveryPolicy(protocols.ZabRecoveryPolicy(*recoveryPolicyPtr), *maxPendingPtr)
+		switch *failureDetectorPtr {
+		case "phi":
+			config := protocols.DefaultPhiAccrualConfig()
+			config.Threshold = *phiThresholdPtr
+			node.SetFailureDetector(protocols.MakePhiAccrualDetector(config))
+		case "timeout":
+			node.SetFailureDetector(protocols.MakeTimeoutDetector(*heartbeatTimeoutPtr))
+		default:
+			panic(fmt.Sprintf("unknown failure detector %q", *failureDetectorPtr))
+		}
+		kv := node.KV()
+		kv.Watch("epoch/", func(event protocols.KVEvent) {
+			log.Printf("node %s finished epoch %s", strings.TrimPrefix(event.Key, "epoch/"), event.Value)
+		})
+		if *dataDirPtr != "" {
+			storage, err := protocols.MakeFileZabStorage(fmt.Sprintf("%s/node%d", *dataDirPtr, curNodeId))
+			if err != nil {
+				panic(err)
+			}
+			if err := node.SetStorage(storage); err != nil {
+				panic(err)
+			}
+		}
+		// everyone proposes their flags and trains with whichever config
+		//   committed first
+		if result := waitFor(node, protocols.ProposeHyperparameters(kv, hyperparameters)); result.Err != nil {
+			panic(result.Err)
+		}
+		hyperparameters, _ = protocols.CommittedHyperparameters(kv)
+		log.Printf("training with committed hyperparameters %+v", hyperparameters)
+		kv.Watch(protocols.HYPERPARAMETERS_KEY, func(event protocols.KVEvent) {
+			log.Printf("hyperparameters changed to %s", event.Value)
+		})
+		if *addNodesPtr != "" || *removeNodesPtr != "" {
+			config := reconfigure(node, parseIds(*addNodesPtr), parseIds(*removeNodesPtr), observers)
+			log.Printf("zab config %d has members %v", config.Version, config.Members)
+		}
+		for epoch := 0; epoch < hyperparameters.Epochs; epoch++ {
 			startTime := time.Now()
 			totalSamples = 0
-			trainLoader := ml.MNISTLoader(trainPath, vocab)
+			trainLoader := ml.MNISTLoaderWithBatchSize(trainPath, vocab, hyperparameters.BatchSize)
 			testLoader := ml.MNISTLoader(testPath, vocab)
 			for trainLoader.Scan() {
+				for node.TrainingPaused() {
+					node.Run()
+				}
 				samples, trainLoss = mlp.TrainBatch(trainLoader)
 				totalSamples += samples
 				node.Run()
-				time.Sleep(50 * time.Millisecond)
 			}
 			throughput := float64(totalSamples) / time.Since(startTime).Seconds()
 			log.Printf("Train Epoch: %d, Loss: %.4f, throughput: %f samples/sec", epoch, trainLoss, throughput)
 			mlp.Test(testLoader, util.PlotLogger, epoch)
+			logCommitLatency(node, epoch)
+			kv.Put(fmt.Sprintf("epoch/%d", curNodeId), []byte(strconv.Itoa(epoch)))
+			// a change to the epochs or batch size applies from the next epoch
+			hyperparameters, _ = protocols.CommittedHyperparameters(kv)
 			// nodes[curNodeId].Run()
 		}
+		waitFor(node, kv.SyncGet(fmt.Sprintf("epoch/%d", curNodeId)))
+		synced := node.Sync()
+		for !synced.Done {
+			node.Run()
+		}
+		log.Printf("caught up with the leader's commits at zxid %v", synced.Zxid)
+		for {
+			node.Run()
+		}
+	} else if mode == RAFT {
+		fmt.Println("running raft")
+		net := setup[protocols.RaftMessage](numNodes, port, curNodeId, networkTable, "tcp")
+		net = withFaults(net, curNodeId, networkTable, injector)
+		node := &protocols.RaftNode{}
+		node.Initialize(curNodeId, strconv.Itoa(curNodeId), mlp, net, net, numNodes, leaderId)
+		for epoch := 0; epoch < hyperparameters.Epochs; epoch++ {
+			startTime := time.Now()
+			totalSamples = 0
+			trainLoader := ml.MNISTLoaderWithBatchSize(trainPath, vocab, hyperparameters.BatchSize)
+			testLoader := ml.MNISTLoader(testPath, vocab)
+			for trainLoader.Scan() {
+				samples, trainLoss = mlp.TrainBatch(trainLoader)
+				totalSamples += samples
+				node.Run()
+			}
+			throughput := float64(totalSamples) / time.Since(startTime).Seconds()
+			log.Printf("Train Epoch: %d, Loss: %.4f, throughput: %f samples/sec", epoch, trainLoss, throughput)
+			mlp.Test(testLoader, util.PlotLogger, epoch)
+			logCommitLatency(node, epoch)
+		}
 		for {
 			node.Run()
 		}
+	} else if mode == PBFT {
+		fmt.Println("running pbft")
+		var keys *protocols.PBFTKeys
+		if *keyDirPtr != "" {
+			var err error
+			keys, err = protocols.LoadPBFTKeys(*keyDirPtr, curNodeId, numNodes)
+			if err != nil {
+				panic(err)
+			}
+		} else if *insecureTestKeysPtr {
+			log.Println("pbft is using test keys anyone can forge")
+			keys = protocols.MakeTestPBFTKeys(curNodeId, numNodes)
+		} else {
+			panic("pbft needs -keyDir, or -insecureTestKeys for a local run")
+		}
+		net := setup[protocols.PBFTMessage](numNodes, port, curNodeId, networkTable, "tcp")
+		net = withFaults(net, curNodeId, networkTable, injector)
+		node := &protocols.PBFTNode{}
+		node.Initialize(curNodeId, strconv.Itoa(curNodeId), mlp, net, net, numNodes, leaderId)
+		node.SetKeys(keys)
+		for epoch := 0; epoch < hyperparameters.Epochs; epoch++ {
+			startTime := time.Now()
+			totalSamples = 0
+			trainLoader := ml.MNISTLoaderWithBatchSize(trainPath, vocab, hyperparameters.BatchSize)
+			testLoader := ml.MNISTLoader(testPath, vocab)
+			for trainLoader.Scan() {
+				samples, trainLoss = mlp.TrainBatch(trainLoader)
+				totalSamples += samples
+				node.Run()
+			}
+			throughput := float64(totalSamples) / time.Since(startTime).Seconds()
+			log.Printf("Train Epoch: %d, Loss: %.4f, throughput: %f samples/sec", epoch, trainLoss, throughput)
+			mlp.Test(testLoader, util.PlotLogger, epoch)
+			logCommitLatency(node, epoch)
+		}
+		for {
+			node.Run()
+		}
+	}
+}
+
+// waitFor runs node until result has been filled in
+func waitFor(node protocols.Node[protocols.ZabMessage, protocols.ZabHeartbeat], result *protocols.KVResult) *protocols.KVResult {
+	for !result.Done {
+		node.Run()
+	}
+	return result
+}
+
+// reconfigure adds and removes zab members and runs node until the change
+//   committed. Added nodes get the same ports they would have at startup.
+func reconfigure(node *protocols.ZabNode, add []int, remove []int, observers []int) protocols.ZabConfig {
+	members := make(map[int]protocols.ZabMember)
+	for _, id := range add {
+		members[id] = protocols.ZabMember{
+			Address:          fmt.Sprintf("localhost:%d", 7001+id),
+			HeartbeatAddress: fmt.Sprintf("localhost:%d", 8001+id),
+		}
+	}
+	for _, id := range observers {
+		if member, ok := members[id]; ok {
+			member.Observer = true
+			members[id] = member
+		}
+	}
+	result := node.Reconfigure(members, remove)
+	for !result.Done {
+		node.Run()
+	}
+	return result.Config
+}
+
+// startSwim joins the swim group of every node up to numNodes
+func startSwim(curNodeId int, numNodes int, injector *network.FaultInjector) *protocols.Swim {
+	swimNetworkTable := make(map[int]string)
+	seeds := make([]int, 0, numNodes)
+	for i := 0; i < numNodes; i++ {
+		swimNetworkTable[i] = fmt.Sprintf("localhost:%d", 9001+i)
+		if i != curNodeId {
+			seeds = append(seeds, i)
+		}
+	}
+	swimPort := ":" + strings.Split(swimNetworkTable[curNodeId], ":")[1]
+	net := setup[protocols.SwimMessage](numNodes, swimPort, curNodeId, swimNetworkTable, "udp")
+	net = withFaults(net, curNodeId, swimNetworkTable, injector)
+	swim := protocols.MakeSwim(curNodeId, swimNetworkTable[curNodeId], net, time.Now().UnixNano())
+	swim.Subscribe(func(event protocols.SwimEvent) {
+		log.Printf("swim: node %d %s (incarnation %d)", event.Member.Id, event.Kind, event.Member.Incarnation)
+	})
+	swim.Start(seeds)
+	return swim
+}
+
+// parseGroups parses -quorumGroups, with no groups every voter is in one
+func parseGroups(list string, numNodes int, observers []int) [][]int {
+	groups := make([][]int, 0)
+	for _, group := range strings.Split(list, ";") {
+		if ids := parseIds(group); len(ids) > 0 {
+			groups = append(groups, ids)
+		}
+	}
+	if len(groups) > 0 {
+		return groups
+	}
+	isObserver := make(map[int]bool)
+	for _, id := range observers {
+		isObserver[id] = true
+	}
+	voters := make([]int, 0, numNodes)
+	for id := 0; id < numNodes; id++ {
+		if !isObserver[id] {
+			voters = append(voters, id)
+		}
+	}
+	return [][]int{voters}
+}
+
+func parseWeights(list string) map[int]int {
+	weights := make(map[int]int)
+	for _, field := range strings.Split(list, ",") {
+		if field == "" {
+			continue
+		}
+		pair := strings.Split(field, ":")
+		if len(pair) != 2 {
+			panic(fmt.Sprintf("bad weight %q, expected id:weight", field))
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(pair[0]))
+		if err != nil {
+			panic(fmt.Sprintf("bad node id %q", pair[0]))
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(pair[1]))
+		if err != nil {
+			panic(fmt.Sprintf("bad weight %q", pair[1]))
+		}
+		weights[id] = weight
+	}
+	return weights
+}
+
+func parseIds(list string) []int {
+	ids := make([]int, 0)
+	for _, field := range strings.Split(list, ",") {
+		if field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			panic(fmt.Sprintf("bad node id %q", field))
+		}
+		ids = append(ids, id)
 	}
+	return ids
 }
@@ -2,11 +2,22 @@ package ml
 
 import (
 	"flads/util"
+	"log"
 	"math/rand"
+
+	torch "github.com/wangkuiyi/gotorch"
+	"github.com/wangkuiyi/gotorch/vision/imageloader"
 )
 
 type DumbMLProcess struct {
 	model int
+	rng   *rand.Rand
+}
+
+// A seeded DumbMLProcess decides when gradients are ready from its own
+//   source, so simulated runs are reproducible
+func MakeDumbMLProcess(seed int64) *DumbMLProcess {
+	return &DumbMLProcess{0, rand.New(rand.NewSource(seed))}
 }
 
 func (ml DumbMLProcess) Initialize() {
@@ -15,7 +26,12 @@ func (ml DumbMLProcess) Initialize() {
 
 func (ml *DumbMLProcess) GetGradients() (bool, Gradients) {
 	// util.Debug("getting gradients")
-	isReady := rand.Intn(2)
+	var isReady int
+	if ml.rng != nil {
+		isReady = ml.rng.Intn(2)
+	} else {
+		isReady = rand.Intn(2)
+	}
 	grads := Gradients{}
 	return isReady == 1, Gradients(grads)
 }
@@ -24,3 +40,23 @@ func (ml *DumbMLProcess) UpdateModel(grads Gradients) {
 	util.Debug("updating model")
 	ml.model = ml.model + 1
 }
+
+// the dumb model only counts updates, so it has no learning rate
+func (ml *DumbMLProcess) SetLearningRate(lr float64) {}
+
+func (ml *DumbMLProcess) TrainBatch(trainLoader *imageloader.ImageLoader) (int, float32) {
+	return 0, 0
+}
+
+func (ml *DumbMLProcess) Test(testLoader *imageloader.ImageLoader, plotLogger *log.Logger, epochNum int) {
+	plotLogger.Printf("Epoch: %d, Updates: %d\n", epochNum, ml.model)
+}
+
+// The dumb model is just an update count, which is stored in W1
+func (ml *DumbMLProcess) GetWeights() MLPWeights {
+	return MLPWeights{W1: torch.Full([]int64{1}, float32(ml.model), false)}
+}
+
+func (ml *DumbMLProcess) SetWeights(weights MLPWeights) {
+	ml.model = int(weights.W1.Item().(float32))
+}
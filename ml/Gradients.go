@@ -0,0 +1,67 @@
+package ml
+
+import (
+	"io"
+
+	torch "github.com/wangkuiyi/gotorch"
+)
+
+// MergeGradients sums every buffered gradient into a single one, so they
+//   are all applied by one UpdateModel and only take the space of one
+func MergeGradients(grads []Gradients) Gradients {
+	return scaleGradients(grads, func(n int) float32 { return 1 })
+}
+
+// AverageGradients averages every buffered gradient into a single one
+func AverageGradients(grads []Gradients) Gradients {
+	return scaleGradients(grads, func(n int) float32 { return float32(1) / float32(n) })
+}
+
+// scaleGradients adds up every buffered gradient, each multiplied by
+//   scale of their number
+func scaleGradients(grads []Gradients, scale func(n int) float32) Gradients {
+	buffer := []MLPGrads{}
+	for _, g := range grads {
+		buffer = append(buffer, g.GradBuffer...)
+	}
+	if len(buffer) == 0 {
+		return Gradients{}
+	}
+
+	// a + alpha * b is the only arithmetic we rely on, see copyTensor
+	alpha := scale(len(buffer))
+	sum := func(get func(MLPGrads) torch.Tensor) torch.Tensor {
+		total := torch.Full(get(buffer[0]).Shape(), 0, false)
+		for _, mlpgrads := range buffer {
+			total = torch.Add(total, get(mlpgrads), alpha)
+		}
+		return total
+	}
+
+	return Gradients{GradBuffer: []MLPGrads{{
+		W1: sum(func(g MLPGrads) torch.Tensor { return g.W1 }),
+		W2: sum(func(g MLPGrads) torch.Tensor { return g.W2 }),
+		W3: sum(func(g MLPGrads) torch.Tensor { return g.W3 }),
+		B1: sum(func(g MLPGrads) torch.Tensor { return g.B1 }),
+		B2: sum(func(g MLPGrads) torch.Tensor { return g.B2 }),
+		B3: sum(func(g MLPGrads) torch.Tensor { return g.B3 }),
+	}}}
+}
+
+// HashGradients writes the encoding of every tensor in grads to w, so
+//   equal gradients hash the same on every node
+func HashGradients(w io.Writer, grads Gradients) error {
+	for _, mlpgrads := range grads.GradBuffer {
+		tensors := []torch.Tensor{mlpgrads.W1, mlpgrads.W2, mlpgrads.W3, mlpgrads.B1, mlpgrads.B2, mlpgrads.B3}
+		for _, tensor := range tensors {
+			data, err := tensor.GobEncode()
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package ml
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+const (
+	CONSTANT_LR    = "constant"
+	STEP_LR        = "step"
+	EXPONENTIAL_LR = "exponential"
+)
+
+// LRSchedule decays the learning rate by Gamma every Every model updates.
+//   It counts updates rather than time or epochs, so every replica that
+//   applied the same updates uses the same rate.
+type LRSchedule struct {
+	Kind  string
+	Every int
+	Gamma float64
+}
+
+type Hyperparameters struct {
+	LearningRate float64
+	Schedule     LRSchedule
+	BatchSize    int
+	Epochs       int
+}
+
+func (h Hyperparameters) Validate() error {
+	if h.LearningRate <= 0 || h.BatchSize <= 0 || h.Epochs <= 0 {
+		return fmt.Errorf("learning rate, batch size and epochs have to be positive")
+	}
+	switch h.Schedule.Kind {
+	case CONSTANT_LR:
+	case STEP_LR, EXPONENTIAL_LR:
+		if h.Schedule.Every <= 0 || h.Schedule.Gamma <= 0 {
+			return fmt.Errorf("a %s schedule needs a positive interval and gamma", h.Schedule.Kind)
+		}
+	default:
+		return fmt.Errorf("unknown learning rate schedule %q", h.Schedule.Kind)
+	}
+	return nil
+}
+
+// LearningRateAt is the learning rate for the update after the first
+//   updates ones
+func (h Hyperparameters) LearningRateAt(updates int) float64 {
+	switch h.Schedule.Kind {
+	case STEP_LR:
+		return h.LearningRate * math.Pow(h.Schedule.Gamma, float64(updates/h.Schedule.Every))
+	case EXPONENTIAL_LR:
+		return h.LearningRate * math.Pow(h.Schedule.Gamma, float64(updates)/float64(h.Schedule.Every))
+	}
+	return h.LearningRate
+}
+
+func (h Hyperparameters) Encode() ([]byte, error) {
+	return json.Marshal(h)
+}
+
+func DecodeHyperparameters(data []byte) (Hyperparameters, error) {
+	var h Hyperparameters
+	if err := json.Unmarshal(data, &h); err != nil {
+		return h, err
+	}
+	return h, h.Validate()
+}
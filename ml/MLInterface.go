@@ -16,9 +16,21 @@ type Gradients struct {
 	GradBuffer []MLPGrads
 }
 
+type MLPWeights struct {
+	W1, W2, W3 torch.Tensor
+	B1, B2, B3 torch.Tensor
+}
+
 type MLProcess interface {
 	GetGradients() (ready bool, gradients Gradients)
 	UpdateModel(incomingGradients Gradients)
 	TrainBatch(trainLoader *imageloader.ImageLoader) (int, float32)
 	Test(testLoader *imageloader.ImageLoader, plotLogger *log.Logger, epochNum int)
+
+	// GetWeights returns a copy of the current weights, for snapshots
+	GetWeights() MLPWeights
+	SetWeights(weights MLPWeights)
+
+	// SetLearningRate changes the rate UpdateModel uses from then on
+	SetLearningRate(lr float64)
 }
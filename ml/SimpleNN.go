@@ -132,6 +132,10 @@ func (model *SimpleNN) UpdateModel(incomingGradients Gradients) {
 	}
 }
 
+func (model *SimpleNN) SetLearningRate(lr float64) {
+	model.lr = lr
+}
+
 func (model *SimpleNN) GetGradients() (ready bool, gradients Gradients) {
 	// flush gradient buffer
 	model.lock.Lock()
@@ -165,3 +169,29 @@ func (model *SimpleNN) GetGradients() (ready bool, gradients Gradients) {
 		return false, Gradients{}
 	}
 }
+
+func (model *SimpleNN) GetWeights() MLPWeights {
+	model.lock.Lock()
+	defer model.lock.Unlock()
+
+	return MLPWeights{
+		copyTensor(model.net.FC1.Weight),
+		copyTensor(model.net.FC2.Weight),
+		copyTensor(model.net.FC3.Weight),
+		copyTensor(model.net.FC1.Bias),
+		copyTensor(model.net.FC2.Bias),
+		copyTensor(model.net.FC3.Bias),
+	}
+}
+
+func (model *SimpleNN) SetWeights(weights MLPWeights) {
+	model.lock.Lock()
+	defer model.lock.Unlock()
+
+	model.net.FC1.Weight.SetData(copyTensor(weights.W1))
+	model.net.FC2.Weight.SetData(copyTensor(weights.W2))
+	model.net.FC3.Weight.SetData(copyTensor(weights.W3))
+	model.net.FC1.Bias.SetData(copyTensor(weights.B1))
+	model.net.FC2.Bias.SetData(copyTensor(weights.B2))
+	model.net.FC3.Bias.SetData(copyTensor(weights.B3))
+}
@@ -127,6 +127,10 @@ func (model *SmallNN) UpdateModel(incomingGradients Gradients) {
 	}
 }
 
+func (model *SmallNN) SetLearningRate(lr float64) {
+	model.lr = lr
+}
+
 func (model *SmallNN) GetGradients() (ready bool, gradients Gradients) {
 	// flush gradient buffer
 	// model.lock.Lock()
@@ -142,3 +146,29 @@ func (model *SmallNN) GetGradients() (ready bool, gradients Gradients) {
 		return false, Gradients{}
 	}
 }
+
+func (model *SmallNN) GetWeights() MLPWeights {
+	return MLPWeights{
+		copyTensor(model.net.FC1.Weight),
+		copyTensor(model.net.FC2.Weight),
+		copyTensor(model.net.FC3.Weight),
+		copyTensor(model.net.FC1.Bias),
+		copyTensor(model.net.FC2.Bias),
+		copyTensor(model.net.FC3.Bias),
+	}
+}
+
+func (model *SmallNN) SetWeights(weights MLPWeights) {
+	model.net.FC1.Weight.SetData(copyTensor(weights.W1))
+	model.net.FC2.Weight.SetData(copyTensor(weights.W2))
+	model.net.FC3.Weight.SetData(copyTensor(weights.W3))
+	model.net.FC1.Bias.SetData(copyTensor(weights.B1))
+	model.net.FC2.Bias.SetData(copyTensor(weights.B2))
+	model.net.FC3.Bias.SetData(copyTensor(weights.B3))
+}
+
+// same hack to copy as in addGradientsToBuffer
+func copyTensor(t torch.Tensor) torch.Tensor {
+	tCopy := torch.Full(t.Shape(), 0, false)
+	return torch.Add(tCopy, t, 1.)
+}
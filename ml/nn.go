@@ -92,8 +92,12 @@ func (model *SmallNN) TrainBatch(trainLoader *imageloader.ImageLoader) (int, flo
 
 // MNISTLoader returns a ImageLoader with MNIST training or testing tgz file
 func MNISTLoader(fn string, vocab map[string]int) *imageloader.ImageLoader {
+	return MNISTLoaderWithBatchSize(fn, vocab, 64)
+}
+
+func MNISTLoaderWithBatchSize(fn string, vocab map[string]int, batchSize int) *imageloader.ImageLoader {
 	trans := transforms.Compose(transforms.ToTensor(), transforms.Normalize([]float32{0.1307}, []float32{0.3081}))
-	loader, e := imageloader.New(fn, vocab, trans, 64, 64, time.Now().UnixNano(), torch.IsCUDAAvailable(), "gray")
+	loader, e := imageloader.New(fn, vocab, trans, batchSize, 64, time.Now().UnixNano(), torch.IsCUDAAvailable(), "gray")
 	if e != nil {
 		panic(e)
 	}
@@ -0,0 +1,28 @@
+package util
+
+import "time"
+
+// Clock is the only source of time for the protocols and networks, so a
+//   simulation can swap in a virtual clock and replay a run exactly.
+//   Anything periodic should reschedule itself with AfterFunc rather than
+//   sleep in a goroutine.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type Timer interface {
+	Stop() bool
+}
+
+type RealClock struct{}
+
+var SystemClock Clock = RealClock{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}